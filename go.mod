@@ -2,4 +2,4 @@ module dumpPayloadFromRTP
 
 go 1.13
 
-require github.com/giorgisio/goav v0.1.0 // indirect
+require github.com/giorgisio/goav v0.1.0
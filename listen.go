@@ -0,0 +1,104 @@
+package main
+
+import (
+	"dumpPayloadFromRTP/rtptool"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var ErrCheckListenAddr = errors.New("check listen addr error")
+
+func runListen(args []string) {
+	param, err := parseListenParam(args)
+	if err != nil {
+		return
+	}
+	listen(param)
+}
+
+func parseListenParam(args []string) (*rtptool.ConsoleParam, error) {
+	param := &rtptool.ConsoleParam{}
+	fs := newFlagSet("listen", param)
+	fs.StringVar(&param.ListenTCP, "tcp", "", "tcp passive mode, wait for the sender to connect, e.g. :9000")
+	fs.StringVar(&param.DialTCP, "tcp-active", "", "tcp active mode, connect to the sender, e.g. 192.168.1.10:9000")
+	fs.StringVar(&param.ListenUDP, "udp", "", "listen udp, e.g. :9000")
+	fs.StringVar(&param.RecordFile, "record", "", "record raw stream, tcp payload for tcp, rtpdump for udp")
+	fs.DurationVar(&param.StatsInterval, "stats-interval", 5*time.Second, "print rolling statistics interval, 0 disable")
+	fs.BoolVar(&param.ParsePs, "ps", false, "parse ps of the first stream while receiving")
+	addRtpFlags(fs, param)
+	addOutputFlags(fs, param)
+	addPsFlags(fs, param)
+	fs.Parse(args)
+	modes := 0
+	for _, addr := range []string{param.ListenTCP, param.DialTCP, param.ListenUDP} {
+		if addr != "" {
+			modes++
+		}
+	}
+	if modes != 1 {
+		log.Println("need one of -tcp, -tcp-active, -udp")
+		fs.Usage()
+		return nil, ErrCheckListenAddr
+	}
+	return param, nil
+}
+
+func openLiveFramer(param *rtptool.ConsoleParam, record io.Writer) (rtptool.LiveFramer, error) {
+	switch {
+	case param.ListenTCP != "":
+		return rtptool.ListenTCP(param.ListenTCP, record)
+	case param.DialTCP != "":
+		return rtptool.DialTCP(param.DialTCP, record)
+	}
+	return rtptool.ListenUDP(param.ListenUDP, record)
+}
+
+// listen 实时接收rtp, 作为GB28181流媒体服务器的替身, Ctrl-C结束后打印统计
+func listen(param *rtptool.ConsoleParam) {
+	var record io.Writer
+	if param.RecordFile != "" {
+		file, err := os.Create(param.RecordFile)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer file.Close()
+		record = file
+	}
+	framer, err := openLiveFramer(param, record)
+	if err != nil {
+		return
+	}
+	decoder := rtptool.NewRTPDecoder(framer, 0, param)
+	if decoder == nil {
+		return
+	}
+	if err := decoder.OpenFiles(); err != nil {
+		return
+	}
+	var pipe *psPipe
+	if param.ParsePs {
+		pipe = startPsPipe(decoder, param)
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		log.Println("stop receiving")
+		framer.Close()
+	}()
+	if err := decoder.DecodePkts(); err != nil {
+		log.Println(err)
+	}
+	framer.Close()
+	decoder.Save()
+	decoder.DumpStream()
+	if pipe != nil {
+		pipe.finish()
+	}
+}
@@ -0,0 +1,545 @@
+// Package pcapparser 解析pcap/pcapng抓包文件，解出Ethernet/IPv4/IPv6/TCP/UDP，
+// 不依赖wireshark/tshark
+package pcapparser
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	pcapMagicMicro     = 0xa1b2c3d4
+	pcapMagicNano      = 0xa1b23c4d
+	pcapngBlockSHB     = 0x0a0d0d0a
+	pcapngBlockIDB     = 0x00000001
+	pcapngBlockPB      = 0x00000002
+	pcapngBlockSPB     = 0x00000003
+	pcapngBlockEPB     = 0x00000006
+	pcapngByteOrderBOM = 0x1a2b3c4d
+	// 单个记录的上限，防止文件损坏时分配超大内存
+	maxRecordLen = 256 * 1024
+)
+
+const (
+	LinkTypeNull     = 0
+	LinkTypeEthernet = 1
+	LinkTypeRaw      = 101
+	LinkTypeLoop     = 108
+	LinkTypeLinuxSLL = 113
+	LinkTypeIPv4     = 228
+	LinkTypeIPv6     = 229
+	LinkTypeSLL2     = 276
+)
+
+const (
+	ProtoTCP = 6
+	ProtoUDP = 17
+)
+
+const (
+	TCPFlagFIN = 0x01
+	TCPFlagSYN = 0x02
+	TCPFlagRST = 0x04
+)
+
+var (
+	ErrNotPcap        = errors.New("not pcap or pcapng file")
+	ErrBadBlock       = errors.New("bad pcapng block")
+	ErrBadRecord      = errors.New("bad pcap record")
+	ErrUnknowLinkType = errors.New("unknown link type")
+	ErrSkipPacket     = errors.New("skip packet")
+	ErrNoStream       = errors.New("no rtp stream found in pcap")
+)
+
+// Flow 单向的五元组
+type Flow struct {
+	Proto   uint8
+	SrcIP   string
+	DstIP   string
+	SrcPort uint16
+	DstPort uint16
+}
+
+// Reverse 反方向的流
+func (f Flow) Reverse() Flow {
+	return Flow{
+		Proto:   f.Proto,
+		SrcIP:   f.DstIP,
+		DstIP:   f.SrcIP,
+		SrcPort: f.DstPort,
+		DstPort: f.SrcPort,
+	}
+}
+
+func (f Flow) String() string {
+	proto := "udp"
+	if f.Proto == ProtoTCP {
+		proto = "tcp"
+	}
+	return fmt.Sprintf("%s %s -> %s", proto,
+		net.JoinHostPort(f.SrcIP, fmt.Sprint(f.SrcPort)),
+		net.JoinHostPort(f.DstIP, fmt.Sprint(f.DstPort)))
+}
+
+// Packet 一个解析好的TCP段或UDP报文
+type Packet struct {
+	Timestamp time.Time
+	// 该包的记录在抓包文件中的偏移
+	Offset  int64
+	Flow    Flow
+	Seq     uint32
+	Flags   uint8
+	Payload []byte
+}
+
+type iface struct {
+	linkType uint16
+	// 时间戳单位，每秒多少个tick
+	tsUnits uint64
+}
+
+// Reader 按顺序读出抓包文件中的TCP/UDP包
+type Reader struct {
+	r      io.Reader
+	pos    int64
+	isNg   bool
+	order  binary.ByteOrder
+	nano   bool
+	link   uint16
+	ifaces []iface
+}
+
+// IsPcap 根据文件头的magic判断是否是pcap或pcapng文件
+func IsPcap(hdr []byte) bool {
+	if len(hdr) < 4 {
+		return false
+	}
+	le := binary.LittleEndian.Uint32(hdr)
+	be := binary.BigEndian.Uint32(hdr)
+	switch {
+	case le == pcapMagicMicro || be == pcapMagicMicro:
+		return true
+	case le == pcapMagicNano || be == pcapMagicNano:
+		return true
+	case be == pcapngBlockSHB:
+		return true
+	}
+	return false
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	reader := &Reader{r: r}
+	hdr := make([]byte, 4)
+	if err := reader.readFull(hdr); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(hdr) == pcapngBlockSHB {
+		reader.isNg = true
+		if err := reader.readSHB(); err != nil {
+			return nil, err
+		}
+		return reader, nil
+	}
+	switch {
+	case binary.LittleEndian.Uint32(hdr) == pcapMagicMicro:
+		reader.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr) == pcapMagicMicro:
+		reader.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(hdr) == pcapMagicNano:
+		reader.order = binary.LittleEndian
+		reader.nano = true
+	case binary.BigEndian.Uint32(hdr) == pcapMagicNano:
+		reader.order = binary.BigEndian
+		reader.nano = true
+	default:
+		return nil, ErrNotPcap
+	}
+	// version(4) thiszone(4) sigfigs(4) snaplen(4) network(4)
+	rest := make([]byte, 20)
+	if err := reader.readFull(rest); err != nil {
+		return nil, err
+	}
+	reader.link = uint16(reader.order.Uint32(rest[16:]))
+	return reader, nil
+}
+
+func (r *Reader) readFull(buf []byte) error {
+	n, err := io.ReadFull(r.r, buf)
+	r.pos += int64(n)
+	if err == io.ErrUnexpectedEOF && n == 0 {
+		return io.EOF
+	}
+	return err
+}
+
+// ReadPacket 返回下一个TCP/UDP包，非IP或者不认识的包会被跳过，读完返回io.EOF
+func (r *Reader) ReadPacket() (*Packet, error) {
+	for {
+		offset := r.pos
+		data, ts, link, err := r.readRecord()
+		if err == ErrSkipPacket {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		pkt, err := decodeLink(data, link)
+		if err == ErrSkipPacket {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		pkt.Timestamp = ts
+		pkt.Offset = offset
+		return pkt, nil
+	}
+}
+
+func (r *Reader) readRecord() ([]byte, time.Time, uint16, error) {
+	if r.isNg {
+		return r.readBlock()
+	}
+	hdr := make([]byte, 16)
+	if err := r.readFull(hdr); err != nil {
+		return nil, time.Time{}, 0, err
+	}
+	sec := r.order.Uint32(hdr[0:])
+	frac := r.order.Uint32(hdr[4:])
+	inclLen := r.order.Uint32(hdr[8:])
+	if inclLen > maxRecordLen {
+		return nil, time.Time{}, 0, ErrBadRecord
+	}
+	data := make([]byte, inclLen)
+	if err := r.readFull(data); err != nil {
+		return nil, time.Time{}, 0, checkEOF(err)
+	}
+	nsec := int64(frac) * 1000
+	if r.nano {
+		nsec = int64(frac)
+	}
+	return data, time.Unix(int64(sec), nsec), r.link, nil
+}
+
+// readSHB 解析section header block, block type已经读过了
+func (r *Reader) readSHB() error {
+	// block total length(4) byte-order magic(4)
+	hdr := make([]byte, 8)
+	if err := r.readFull(hdr); err != nil {
+		return checkEOF(err)
+	}
+	// 新的section字节序可能会变
+	switch {
+	case binary.LittleEndian.Uint32(hdr[4:]) == pcapngByteOrderBOM:
+		r.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr[4:]) == pcapngByteOrderBOM:
+		r.order = binary.BigEndian
+	default:
+		return ErrBadBlock
+	}
+	total := r.order.Uint32(hdr[0:])
+	if total < 16 || total%4 != 0 || total > maxRecordLen {
+		return ErrBadBlock
+	}
+	// 每个section的interface id从0开始
+	r.ifaces = r.ifaces[:0]
+	return checkEOF(r.readFull(make([]byte, total-12)))
+}
+
+func (r *Reader) readBlock() ([]byte, time.Time, uint16, error) {
+	blockTypeBuf := make([]byte, 4)
+	if err := r.readFull(blockTypeBuf); err != nil {
+		return nil, time.Time{}, 0, err
+	}
+	if binary.BigEndian.Uint32(blockTypeBuf) == pcapngBlockSHB {
+		if err := r.readSHB(); err != nil {
+			return nil, time.Time{}, 0, err
+		}
+		return nil, time.Time{}, 0, ErrSkipPacket
+	}
+	hdr := make([]byte, 4)
+	if err := r.readFull(hdr); err != nil {
+		return nil, time.Time{}, 0, checkEOF(err)
+	}
+	blockType := r.order.Uint32(blockTypeBuf)
+	total := r.order.Uint32(hdr)
+	if total < 12 || total%4 != 0 || total > maxRecordLen {
+		return nil, time.Time{}, 0, ErrBadBlock
+	}
+	body := make([]byte, total-8)
+	if err := r.readFull(body); err != nil {
+		return nil, time.Time{}, 0, checkEOF(err)
+	}
+	body = body[:len(body)-4]
+	switch blockType {
+	case pcapngBlockIDB:
+		return nil, time.Time{}, 0, r.decodeIDB(body)
+	case pcapngBlockEPB:
+		if len(body) < 20 {
+			return nil, time.Time{}, 0, ErrBadBlock
+		}
+		ifID := r.order.Uint32(body[0:])
+		ts := uint64(r.order.Uint32(body[4:]))<<32 | uint64(r.order.Uint32(body[8:]))
+		capLen := r.order.Uint32(body[12:])
+		if int(capLen) > len(body)-20 {
+			return nil, time.Time{}, 0, ErrBadBlock
+		}
+		return r.packetOfIface(ifID, ts, body[20:20+capLen])
+	case pcapngBlockPB:
+		if len(body) < 20 {
+			return nil, time.Time{}, 0, ErrBadBlock
+		}
+		ifID := uint32(r.order.Uint16(body[0:]))
+		ts := uint64(r.order.Uint32(body[4:]))<<32 | uint64(r.order.Uint32(body[8:]))
+		capLen := r.order.Uint32(body[12:])
+		if int(capLen) > len(body)-20 {
+			return nil, time.Time{}, 0, ErrBadBlock
+		}
+		return r.packetOfIface(ifID, ts, body[20:20+capLen])
+	case pcapngBlockSPB:
+		if len(body) < 4 {
+			return nil, time.Time{}, 0, ErrBadBlock
+		}
+		origLen := r.order.Uint32(body[0:])
+		data := body[4:]
+		if int(origLen) < len(data) {
+			data = data[:origLen]
+		}
+		// simple packet block没有时间戳
+		_, _, link, err := r.packetOfIface(0, 0, nil)
+		return data, time.Time{}, link, err
+	}
+	return nil, time.Time{}, 0, ErrSkipPacket
+}
+
+func (r *Reader) decodeIDB(body []byte) error {
+	if len(body) < 8 {
+		return ErrBadBlock
+	}
+	ifc := iface{
+		linkType: r.order.Uint16(body[0:]),
+		tsUnits:  1000000,
+	}
+	// options
+	opts := body[8:]
+	for len(opts) >= 4 {
+		code := r.order.Uint16(opts[0:])
+		optLen := int(r.order.Uint16(opts[2:]))
+		if code == 0 || 4+optLen > len(opts) {
+			break
+		}
+		// if_tsresol, 最高位为1时是2的幂, 否则是10的幂. 最多到纳秒, 再大时间戳换算会溢出
+		if code == 9 && optLen >= 1 {
+			v := opts[4]
+			if (v&0x80 == 0 && v > 9) || (v&0x80 != 0 && v&0x7f > 30) {
+				return ErrBadBlock
+			}
+			units := uint64(1)
+			for i := 0; i < int(v&0x7f); i++ {
+				if v&0x80 != 0 {
+					units *= 2
+				} else {
+					units *= 10
+				}
+			}
+			ifc.tsUnits = units
+		}
+		opts = opts[4+(optLen+3)&^3:]
+	}
+	r.ifaces = append(r.ifaces, ifc)
+	return ErrSkipPacket
+}
+
+func (r *Reader) packetOfIface(ifID uint32, ts uint64, data []byte) ([]byte, time.Time, uint16, error) {
+	if int(ifID) >= len(r.ifaces) {
+		return nil, time.Time{}, 0, ErrBadBlock
+	}
+	ifc := r.ifaces[ifID]
+	sec := ts / ifc.tsUnits
+	nsec := (ts % ifc.tsUnits) * 1000000000 / ifc.tsUnits
+	return data, time.Unix(int64(sec), int64(nsec)), ifc.linkType, nil
+}
+
+func decodeLink(data []byte, link uint16) (*Packet, error) {
+	switch link {
+	case LinkTypeEthernet:
+		return decodeEthernet(data)
+	case LinkTypeRaw, LinkTypeIPv4, LinkTypeIPv6:
+		return decodeIP(data)
+	case LinkTypeNull, LinkTypeLoop:
+		// 4个字节的协议族，字节序不确定，直接看ip版本号
+		if len(data) < 4 {
+			return nil, ErrSkipPacket
+		}
+		return decodeIP(data[4:])
+	case LinkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil, ErrSkipPacket
+		}
+		return decodeEtherType(binary.BigEndian.Uint16(data[14:]), data[16:])
+	case LinkTypeSLL2:
+		if len(data) < 20 {
+			return nil, ErrSkipPacket
+		}
+		return decodeEtherType(binary.BigEndian.Uint16(data[0:]), data[20:])
+	}
+	return nil, ErrUnknowLinkType
+}
+
+func decodeEthernet(data []byte) (*Packet, error) {
+	if len(data) < 14 {
+		return nil, ErrSkipPacket
+	}
+	etherType := binary.BigEndian.Uint16(data[12:])
+	data = data[14:]
+	// 802.1Q/802.1ad vlan tag
+	for etherType == 0x8100 || etherType == 0x88a8 {
+		if len(data) < 4 {
+			return nil, ErrSkipPacket
+		}
+		etherType = binary.BigEndian.Uint16(data[2:])
+		data = data[4:]
+	}
+	return decodeEtherType(etherType, data)
+}
+
+func decodeEtherType(etherType uint16, data []byte) (*Packet, error) {
+	if etherType != 0x0800 && etherType != 0x86dd {
+		return nil, ErrSkipPacket
+	}
+	return decodeIP(data)
+}
+
+func decodeIP(data []byte) (*Packet, error) {
+	if len(data) < 1 {
+		return nil, ErrSkipPacket
+	}
+	switch data[0] >> 4 {
+	case 4:
+		return decodeIPv4(data)
+	case 6:
+		return decodeIPv6(data)
+	}
+	return nil, ErrSkipPacket
+}
+
+func decodeIPv4(data []byte) (*Packet, error) {
+	if len(data) < 20 {
+		return nil, ErrSkipPacket
+	}
+	ihl := int(data[0]&0x0f) * 4
+	totalLen := int(binary.BigEndian.Uint16(data[2:]))
+	if ihl < 20 || totalLen < ihl || totalLen > len(data) {
+		// 有些网卡offload抓到的total length为0，按实际长度处理
+		if totalLen == 0 && ihl >= 20 && ihl <= len(data) {
+			totalLen = len(data)
+		} else {
+			return nil, ErrSkipPacket
+		}
+	}
+	// 分片的包不处理
+	fragment := binary.BigEndian.Uint16(data[6:])
+	if fragment&0x3fff != 0 {
+		return nil, ErrSkipPacket
+	}
+	flow := Flow{
+		Proto: data[9],
+		SrcIP: net.IP(data[12:16]).String(),
+		DstIP: net.IP(data[16:20]).String(),
+	}
+	return decodeTransport(flow, data[ihl:totalLen])
+}
+
+func decodeIPv6(data []byte) (*Packet, error) {
+	if len(data) < 40 {
+		return nil, ErrSkipPacket
+	}
+	payloadLen := int(binary.BigEndian.Uint16(data[4:]))
+	next := data[6]
+	flow := Flow{
+		SrcIP: net.IP(data[8:24]).String(),
+		DstIP: net.IP(data[24:40]).String(),
+	}
+	data = data[40:]
+	if payloadLen != 0 && payloadLen <= len(data) {
+		data = data[:payloadLen]
+	}
+	for {
+		switch next {
+		case 0, 43, 60:
+			// hop-by-hop, routing, destination options
+			if len(data) < 8 {
+				return nil, ErrSkipPacket
+			}
+			extLen := (int(data[1]) + 1) * 8
+			if extLen > len(data) {
+				return nil, ErrSkipPacket
+			}
+			next = data[0]
+			data = data[extLen:]
+		case 51:
+			// AH
+			if len(data) < 8 {
+				return nil, ErrSkipPacket
+			}
+			extLen := (int(data[1]) + 2) * 4
+			if extLen > len(data) {
+				return nil, ErrSkipPacket
+			}
+			next = data[0]
+			data = data[extLen:]
+		default:
+			// 44是分片头，和ipv4一样不处理
+			flow.Proto = next
+			return decodeTransport(flow, data)
+		}
+	}
+}
+
+func decodeTransport(flow Flow, data []byte) (*Packet, error) {
+	switch flow.Proto {
+	case ProtoTCP:
+		if len(data) < 20 {
+			return nil, ErrSkipPacket
+		}
+		dataOffset := int(data[12]>>4) * 4
+		if dataOffset < 20 || dataOffset > len(data) {
+			return nil, ErrSkipPacket
+		}
+		flow.SrcPort = binary.BigEndian.Uint16(data[0:])
+		flow.DstPort = binary.BigEndian.Uint16(data[2:])
+		return &Packet{
+			Flow:    flow,
+			Seq:     binary.BigEndian.Uint32(data[4:]),
+			Flags:   data[13],
+			Payload: data[dataOffset:],
+		}, nil
+	case ProtoUDP:
+		if len(data) < 8 {
+			return nil, ErrSkipPacket
+		}
+		udpLen := int(binary.BigEndian.Uint16(data[4:]))
+		payload := data[8:]
+		if udpLen >= 8 && udpLen-8 <= len(payload) {
+			payload = payload[:udpLen-8]
+		}
+		flow.SrcPort = binary.BigEndian.Uint16(data[0:])
+		flow.DstPort = binary.BigEndian.Uint16(data[2:])
+		return &Packet{
+			Flow:    flow,
+			Payload: payload,
+		}, nil
+	}
+	return nil, ErrSkipPacket
+}
+
+func checkEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
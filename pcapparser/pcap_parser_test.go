@@ -0,0 +1,44 @@
+package pcapparser
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestDecodeIDBTsresol(t *testing.T) {
+	tests := []struct {
+		name    string
+		tsresol byte
+		units   uint64
+		wantErr bool
+	}{
+		{name: "micro", tsresol: 6, units: 1000000},
+		{name: "nano", tsresol: 9, units: 1000000000},
+		{name: "power of 2", tsresol: 0x80 | 10, units: 1024},
+		{name: "max power of 2", tsresol: 0x80 | 30, units: 1 << 30},
+		{name: "power of 10 too large", tsresol: 10, wantErr: true},
+		{name: "power of 10 wraps", tsresol: 64, wantErr: true},
+		{name: "power of 2 too large", tsresol: 0x80 | 31, wantErr: true},
+		{name: "power of 2 wraps", tsresol: 0x80 | 64, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Reader{order: binary.LittleEndian}
+			// link type(2) reserved(2) snaplen(4), if_tsresol, opt_endofopt
+			body := []byte{1, 0, 0, 0, 0, 0, 1, 0, 9, 0, 1, 0, tt.tsresol, 0, 0, 0, 0, 0, 0, 0}
+			err := r.decodeIDB(body)
+			if tt.wantErr {
+				if err != ErrBadBlock || len(r.ifaces) != 0 {
+					t.Fatalf("got err: %v ifaces: %d, want %v", err, len(r.ifaces), ErrBadBlock)
+				}
+				return
+			}
+			if err != ErrSkipPacket || len(r.ifaces) != 1 {
+				t.Fatalf("got err: %v ifaces: %d", err, len(r.ifaces))
+			}
+			if r.ifaces[0].tsUnits != tt.units {
+				t.Errorf("ts units: got %d, want %d", r.ifaces[0].tsUnits, tt.units)
+			}
+		})
+	}
+}
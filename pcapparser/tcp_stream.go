@@ -0,0 +1,158 @@
+package pcapparser
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// 乱序缓存的上限，超过了认为中间的段抓包时丢了，直接跳过空洞
+const maxPendingBytes = 4 * 1024 * 1024
+
+// Segment 重组后按序输出的一段tcp负载
+type Segment struct {
+	Data      []byte
+	Timestamp time.Time
+	// 该段所在的包在抓包文件中的偏移
+	Offset int64
+	// 这一段之前跳过了空洞, 和之前输出的数据不连续, GapBytes是空洞的字节数
+	Gap      bool
+	GapBytes int
+}
+
+// TCPStream 单向tcp流的重组，处理乱序、重传和重叠
+type TCPStream struct {
+	Flow         Flow
+	started      bool
+	nextSeq      uint32
+	pending      []*Packet
+	pendingBytes int
+	// 跳过的空洞个数和字节数
+	GapCount   int
+	GapBytes   uint64
+	RetransCnt int
+}
+
+func NewTCPStream(flow Flow) *TCPStream {
+	return &TCPStream{Flow: flow}
+}
+
+// tcp序列号有回绕，用差值的符号比较先后
+func seqDiff(a, b uint32) int32 {
+	return int32(a - b)
+}
+
+// Add 加入一个tcp段，返回可以按序输出的数据
+func (s *TCPStream) Add(pkt *Packet) []Segment {
+	seq := pkt.Seq
+	if pkt.Flags&TCPFlagSYN != 0 {
+		seq++
+		if !s.started {
+			s.started = true
+			s.nextSeq = seq
+		}
+	}
+	if len(pkt.Payload) == 0 {
+		return nil
+	}
+	if !s.started {
+		// 抓包时连接已经建立，从看到的第一个段开始
+		s.started = true
+		s.nextSeq = seq
+	}
+	if seqDiff(seq, s.nextSeq) > 0 {
+		s.insertPending(&Packet{
+			Timestamp: pkt.Timestamp,
+			Offset:    pkt.Offset,
+			Seq:       seq,
+			Payload:   pkt.Payload,
+		})
+		if s.pendingBytes > maxPendingBytes {
+			return s.skipGap()
+		}
+		return nil
+	}
+	segs := s.accept(seq, pkt.Payload, pkt.Timestamp, pkt.Offset)
+	return append(segs, s.drain()...)
+}
+
+// Flush 输入结束时，把乱序缓存里剩下的数据跳过空洞全部输出
+func (s *TCPStream) Flush() []Segment {
+	var segs []Segment
+	for len(s.pending) > 0 {
+		segs = append(segs, s.skipGap()...)
+	}
+	return segs
+}
+
+func (s *TCPStream) accept(seq uint32, data []byte, ts time.Time, offset int64) []Segment {
+	overlap := int(seqDiff(s.nextSeq, seq))
+	if overlap >= len(data) {
+		s.RetransCnt++
+		return nil
+	}
+	if overlap > 0 {
+		data = data[overlap:]
+	}
+	s.nextSeq += uint32(len(data))
+	return []Segment{{Data: data, Timestamp: ts, Offset: offset}}
+}
+
+func (s *TCPStream) insertPending(pkt *Packet) {
+	idx := sort.Search(len(s.pending), func(i int) bool {
+		return seqDiff(s.pending[i].Seq, pkt.Seq) >= 0
+	})
+	if idx < len(s.pending) && s.pending[idx].Seq == pkt.Seq {
+		// 同一个序列号的重传, 保留长的那个
+		s.RetransCnt++
+		if len(s.pending[idx].Payload) < len(pkt.Payload) {
+			s.pendingBytes += len(pkt.Payload) - len(s.pending[idx].Payload)
+			s.pending[idx] = pkt
+		}
+		return
+	}
+	s.pending = append(s.pending, nil)
+	copy(s.pending[idx+1:], s.pending[idx:])
+	s.pending[idx] = pkt
+	s.pendingBytes += len(pkt.Payload)
+}
+
+func (s *TCPStream) drain() []Segment {
+	var segs []Segment
+	for len(s.pending) > 0 && seqDiff(s.pending[0].Seq, s.nextSeq) <= 0 {
+		pkt := s.pending[0]
+		s.pending = s.pending[1:]
+		s.pendingBytes -= len(pkt.Payload)
+		segs = append(segs, s.accept(pkt.Seq, pkt.Payload, pkt.Timestamp, pkt.Offset)...)
+	}
+	return segs
+}
+
+func (s *TCPStream) skipGap() []Segment {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	gap := seqDiff(s.pending[0].Seq, s.nextSeq)
+	log.Printf("%s: tcp segment lost, skip %d bytes, seq: %d, pos: %d", s.Flow, gap, s.nextSeq, s.pending[0].Offset)
+	s.GapCount++
+	s.GapBytes += uint64(gap)
+	s.nextSeq = s.pending[0].Seq
+	segs := s.drain()
+	if len(segs) > 0 {
+		segs[0].Gap = true
+		segs[0].GapBytes = int(gap)
+	}
+	return segs
+}
+
+// LooksLikeRTPOverTCP 判断一段tcp负载是否以RFC 4571的长度+rtp头开始
+func LooksLikeRTPOverTCP(payload []byte) bool {
+	if len(payload) < 2+12 {
+		return false
+	}
+	rtpLen := int(payload[0])<<8 | int(payload[1])
+	if rtpLen < 12 {
+		return false
+	}
+	return payload[2]>>6 == 2
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"dumpPayloadFromRTP/psparser"
+	"dumpPayloadFromRTP/rtptool"
+	"io"
+	"io/ioutil"
+	"log"
+)
+
+// psPipe rtp拼出来的ps不落盘, 通过管道直接交给PsDecoder解析
+type psPipe struct {
+	writer *io.PipeWriter
+	done   chan *psparser.PsDecoder
+}
+
+func startPsPipe(decoder *rtptool.RTPDecoder, param *rtptool.ConsoleParam) *psPipe {
+	reader, writer := io.Pipe()
+	pipe := &psPipe{
+		writer: writer,
+		done:   make(chan *psparser.PsDecoder, 1),
+	}
+	decoder.SetPsWriter(writer)
+	go func() {
+		psDecoder := psparser.NewPsDecoder(reader, 0, param)
+		if psDecoder != nil {
+			if err := psDecoder.DecodePsPkts(); err != nil {
+				log.Println("decode ps err:", err)
+			}
+		}
+		// ps解析出错后丢掉后面的数据, 不影响rtp的解析
+		io.Copy(ioutil.Discard, reader)
+		pipe.done <- psDecoder
+	}()
+	return pipe
+}
+
+// finish rtp输入结束, 等ps解析完后打印ps的统计
+func (pipe *psPipe) finish() {
+	pipe.writer.Close()
+	if psDecoder := <-pipe.done; psDecoder != nil {
+		psDecoder.ShowInfo()
+		psDecoder.Close()
+	}
+}
@@ -0,0 +1,270 @@
+package psparser
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SCR跳变超过这个时间时不计入时间轴, 避免一次跳变影响漂移的计算, 90kHz
+const maxSCRStep = 10 * ptsPerSec
+
+// avSample 时间序列的一行, 每个带PTS的音频或视频pes一行
+type avSample struct {
+	Pos      int64   `json:"pos"`
+	StreamID string  `json:"stream_id"`
+	Type     string  `json:"type"`
+	PTS      uint64  `json:"pts"`
+	SCR      uint64  `json:"scr"`
+	Elapsed  float64 `json:"elapsed_s"`
+	Lead     float64 `json:"pts_minus_scr_ms"`
+	AVOffset float64 `json:"av_offset_ms"`
+	// 音频和视频都有了之后才有A/V偏差
+	HasOffset bool `json:"has_av_offset"`
+}
+
+// avJump A/V偏差相对上一个样本的跳变
+type avJump struct {
+	pos     int64
+	elapsed float64
+	from    float64
+	to      float64
+}
+
+// avSync 按pack header里的SCR比较音频和视频的PTS.
+// pts-scr是这个pes相对系统时钟提前了多少, 视频和音频的差值就是A/V偏差, 正数表示视频比音频晚播
+type avSync struct {
+	jumpLimit float64
+	hasSCR    bool
+	scr       uint64
+	// SCR累计走过的时间, 秒
+	elapsed    float64
+	scrBack    int
+	scrJumps   int
+	hasVideo   bool
+	videoLead  float64
+	hasAudio   bool
+	audioLead  float64
+	minLead    [2]float64
+	maxLead    [2]float64
+	leadCount  [2]int
+	hasOffset  bool
+	lastOffset float64
+	firstOff   float64
+	minOffset  float64
+	maxOffset  float64
+	offsets    int
+	sumOffset  float64
+	// 最小二乘拟合偏差随时间的变化, 得到漂移. 跳变的部分减掉, 只算连续的漂移
+	jumpBias                 float64
+	sumX, sumY, sumXX, sumXY float64
+	jumps                    []avJump
+	// 时间序列输出
+	file  *os.File
+	w     *bufio.Writer
+	json  bool
+	lines int
+}
+
+const (
+	avVideo = 0
+	avAudio = 1
+)
+
+func newAVSync(file string, jumpMs float64) (*avSync, error) {
+	av := &avSync{jumpLimit: jumpMs}
+	if file == "" {
+		return av, nil
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	av.file = f
+	av.w = bufio.NewWriter(f)
+	av.json = strings.EqualFold(filepath.Ext(file), ".json")
+	if av.json {
+		av.w.WriteString("[\n")
+	} else {
+		av.w.WriteString("pos, stream_id, type, pts, scr, elapsed_s, pts_minus_scr_ms, av_offset_ms\n")
+	}
+	return av, nil
+}
+
+// updateSCR 每个pack header调用一次
+func (av *avSync) updateSCR(scr uint64, pos int64) {
+	if av.hasSCR {
+		d := ptsDiff(scr, av.scr)
+		switch {
+		case d < 0:
+			av.scrBack++
+			log.Printf("scr goes back, pos: %d(0x%x) last: %s current: %s", pos, pos, ptsString(av.scr), ptsString(scr))
+		case d > maxSCRStep:
+			av.scrJumps++
+			log.Printf("scr jumps, pos: %d(0x%x) last: %s current: %s", pos, pos, ptsString(av.scr), ptsString(scr))
+		default:
+			av.elapsed += float64(d) / ptsPerSec
+		}
+	}
+	av.scr = scr
+	av.hasSCR = true
+}
+
+// addPES 每个带PTS的音频或视频pes调用一次
+func (av *avSync) addPES(hdr *PESHeader, pos int64) error {
+	kind := -1
+	switch {
+	case hdr.StreamID >= 0xe0 && hdr.StreamID <= 0xef:
+		kind = avVideo
+	case hdr.StreamID >= 0xc0 && hdr.StreamID <= 0xdf:
+		kind = avAudio
+	}
+	if kind < 0 || !hdr.HasPTS || !av.hasSCR {
+		return nil
+	}
+	lead := float64(ptsDiff(hdr.PTS, av.scr)) * 1000 / ptsPerSec
+	if av.leadCount[kind] == 0 || lead < av.minLead[kind] {
+		av.minLead[kind] = lead
+	}
+	if av.leadCount[kind] == 0 || lead > av.maxLead[kind] {
+		av.maxLead[kind] = lead
+	}
+	av.leadCount[kind]++
+	sample := avSample{
+		Pos:      pos,
+		StreamID: fmt.Sprintf("0x%x", hdr.StreamID),
+		PTS:      hdr.PTS,
+		SCR:      av.scr,
+		Elapsed:  av.elapsed,
+		Lead:     lead,
+	}
+	if kind == avVideo {
+		sample.Type = "video"
+		av.hasVideo = true
+		av.videoLead = lead
+	} else {
+		sample.Type = "audio"
+		av.hasAudio = true
+		av.audioLead = lead
+	}
+	if av.hasVideo && av.hasAudio {
+		sample.HasOffset = true
+		sample.AVOffset = av.videoLead - av.audioLead
+		av.addOffset(sample.AVOffset, pos)
+	}
+	return av.write(&sample)
+}
+
+func (av *avSync) addOffset(offset float64, pos int64) {
+	if !av.hasOffset {
+		av.firstOff = offset
+		av.minOffset = offset
+		av.maxOffset = offset
+	} else if d := offset - av.lastOffset; av.jumpLimit > 0 && (d > av.jumpLimit || d < -av.jumpLimit) {
+		av.jumps = append(av.jumps, avJump{pos: pos, elapsed: av.elapsed, from: av.lastOffset, to: offset})
+		av.jumpBias += d
+	}
+	if offset < av.minOffset {
+		av.minOffset = offset
+	}
+	if offset > av.maxOffset {
+		av.maxOffset = offset
+	}
+	av.hasOffset = true
+	av.lastOffset = offset
+	av.offsets++
+	av.sumOffset += offset
+	av.sumX += av.elapsed
+	y := offset - av.jumpBias
+	av.sumY += y
+	av.sumXX += av.elapsed * av.elapsed
+	av.sumXY += av.elapsed * y
+}
+
+func (av *avSync) write(sample *avSample) error {
+	if av.w == nil {
+		return nil
+	}
+	var err error
+	if av.json {
+		if av.lines > 0 {
+			av.w.WriteString(",\n")
+		}
+		var b []byte
+		if b, err = json.Marshal(sample); err == nil {
+			_, err = av.w.Write(b)
+		}
+	} else {
+		offset := ""
+		if sample.HasOffset {
+			offset = fmt.Sprintf("%.3f", sample.AVOffset)
+		}
+		_, err = fmt.Fprintf(av.w, "%d, %s, %s, %d, %d, %.6f, %.3f, %s\n", sample.Pos, sample.StreamID,
+			sample.Type, sample.PTS, sample.SCR, sample.Elapsed, sample.Lead, offset)
+	}
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	av.lines++
+	return nil
+}
+
+// drift 最小二乘拟合的斜率, 每秒A/V偏差变化多少毫秒
+func (av *avSync) drift() (float64, bool) {
+	n := float64(av.offsets)
+	den := n*av.sumXX - av.sumX*av.sumX
+	if av.offsets < 2 || den == 0 {
+		return 0, false
+	}
+	return (n*av.sumXY - av.sumX*av.sumY) / den, true
+}
+
+// close 结束时间序列的输出
+func (av *avSync) close() error {
+	if av.w == nil {
+		return nil
+	}
+	if av.json {
+		av.w.WriteString("\n]\n")
+	}
+	err := av.w.Flush()
+	if err != nil {
+		log.Println(err)
+	}
+	av.w = nil
+	av.file.Close()
+	return err
+}
+
+func (av *avSync) dump() {
+	fmt.Println()
+	log.Println("a/v sync:")
+	log.Printf("\tscr elapsed: %.3fs goes back: %d jumps: %d", av.elapsed, av.scrBack, av.scrJumps)
+	for kind, name := range []string{"video", "audio"} {
+		if av.leadCount[kind] > 0 {
+			log.Printf("\t%s pts - scr: min %.3fms max %.3fms", name, av.minLead[kind], av.maxLead[kind])
+		}
+	}
+	if !av.hasOffset {
+		log.Println("\tno a/v offset, need both audio and video pts")
+		return
+	}
+	log.Printf("\ta/v offset(video - audio): first %.3fms last %.3fms min %.3fms max %.3fms mean %.3fms",
+		av.firstOff, av.lastOffset, av.minOffset, av.maxOffset, av.sumOffset/float64(av.offsets))
+	if drift, ok := av.drift(); ok {
+		log.Printf("\ta/v drift(without jumps): %.3fms/min", drift*60)
+	}
+	log.Println("\ta/v offset jump count:", len(av.jumps))
+	for _, jump := range av.jumps {
+		log.Printf("\t\tjump: %.3fms -> %.3fms at %.3fs pos: %d(0x%x)", jump.from, jump.to, jump.elapsed, jump.pos, jump.pos)
+	}
+	if av.file != nil {
+		log.Println("\ta/v sync time series:", av.file.Name(), "rows:", av.lines)
+	}
+}
@@ -0,0 +1,461 @@
+package psparser
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+)
+
+// pts/dts是33位的, 90kHz
+const (
+	ptsMask    = 1<<33 - 1
+	ptsPerSec  = 90000
+	ptsHalfMod = 1 << 32
+)
+
+// MPEG-1 pes头最长: 16个填充字节, 2个字节的STD缓冲区大小, 10个字节的PTS和DTS
+const maxMPEG1PESHeaderLen = 16 + 2 + 10
+
+var ErrCheckPESHeader = errors.New("check pes header error")
+
+// PESHeader ISO/IEC 13818-1 2.4.3.7 PES头, Has开头的标志表示对应的可选字段是否存在
+type PESHeader struct {
+	StreamID             uint8
+	MPEG1                bool
+	PacketLength         uint32
+	ScramblingControl    uint8
+	Priority             bool
+	DataAlignment        bool
+	Copyright            bool
+	OriginalOrCopy       bool
+	PTSDTSFlags          uint8
+	HeaderDataLength     uint32
+	HasPTS               bool
+	PTS                  uint64
+	HasDTS               bool
+	DTS                  uint64
+	HasESCR              bool
+	ESCRBase             uint64
+	ESCRExtension        uint32
+	HasESRate            bool
+	ESRate               uint32
+	HasTrickMode         bool
+	TrickModeControl     uint8
+	TrickModeField       uint8
+	HasCopyInfo          bool
+	AdditionalCopyInfo   uint8
+	HasCRC               bool
+	PreviousPESCRC       uint16
+	HasExtension         bool
+	PrivateData          []byte `json:",omitempty"`
+	PackField            []byte `json:",omitempty"`
+	HasSequenceCounter   bool
+	SequenceCounter      uint8
+	MPEG1MPEG2Identifier bool
+	OriginalStuffLength  uint8
+	HasPSTDBuffer        bool
+	PSTDBufferScale      uint8
+	PSTDBufferSize       uint32
+	ExtensionField       []byte `json:",omitempty"`
+	StuffingLength       uint32
+	// 时间戳和标志位的错误, 例如marker位不对
+	Errors []string `json:",omitempty"`
+}
+
+// parseFlags 解析PES_packet_length之后的两个字节的标志
+func (hdr *PESHeader) parseFlags(flags uint16) {
+	hdr.ScramblingControl = uint8(flags>>12) & 0x03
+	hdr.Priority = flags&0x0800 != 0
+	hdr.DataAlignment = flags&0x0400 != 0
+	hdr.Copyright = flags&0x0200 != 0
+	hdr.OriginalOrCopy = flags&0x0100 != 0
+	hdr.PTSDTSFlags = uint8(flags>>6) & 0x03
+	hdr.HasESCR = flags&0x0020 != 0
+	hdr.HasESRate = flags&0x0010 != 0
+	hdr.HasTrickMode = flags&0x0008 != 0
+	hdr.HasCopyInfo = flags&0x0004 != 0
+	hdr.HasCRC = flags&0x0002 != 0
+	hdr.HasExtension = flags&0x0001 != 0
+	if flags>>14 != 0x02 {
+		hdr.addError(fmt.Sprintf("pes header start bits: %d, should be '10'", flags>>14))
+	}
+}
+
+func (hdr *PESHeader) addError(msg string) {
+	hdr.Errors = append(hdr.Errors, msg)
+}
+
+// parseData 按标志解析pes_header_data里的可选字段, 剩下的是填充字节
+func (hdr *PESHeader) parseData(data []byte) error {
+	pos := 0
+	need := func(n int, name string) bool {
+		if pos+n > len(data) {
+			hdr.addError(fmt.Sprintf("%s needs %d bytes, header data left %d", name, n, len(data)-pos))
+			return false
+		}
+		return true
+	}
+	switch hdr.PTSDTSFlags {
+	case 1:
+		hdr.addError("PTS_DTS_flags is forbidden value '01'")
+	case 2, 3:
+		if !need(5, "PTS") {
+			return ErrCheckPESHeader
+		}
+		prefix := byte(0x02)
+		if hdr.PTSDTSFlags == 3 {
+			prefix = 0x03
+		}
+		hdr.HasPTS = true
+		hdr.PTS = hdr.parseTimestamp(data[pos:], prefix, "PTS")
+		pos += 5
+		if hdr.PTSDTSFlags == 3 {
+			if !need(5, "DTS") {
+				return ErrCheckPESHeader
+			}
+			hdr.HasDTS = true
+			hdr.DTS = hdr.parseTimestamp(data[pos:], 0x01, "DTS")
+			pos += 5
+		}
+	}
+	if hdr.HasESCR {
+		if !need(6, "ESCR") {
+			return ErrCheckPESHeader
+		}
+		b := data[pos:]
+		if b[0]&0x04 == 0 || b[2]&0x04 == 0 || b[4]&0x04 == 0 || b[5]&0x01 == 0 {
+			hdr.addError("ESCR marker bit error")
+		}
+		hdr.ESCRBase = uint64(b[0]>>3&0x07)<<30 | uint64(b[0]&0x03)<<28 | uint64(b[1])<<20 |
+			uint64(b[2]>>3)<<15 | uint64(b[2]&0x03)<<13 | uint64(b[3])<<5 | uint64(b[4]>>3)
+		hdr.ESCRExtension = uint32(b[4]&0x03)<<7 | uint32(b[5]>>1)
+		pos += 6
+	}
+	if hdr.HasESRate {
+		if !need(3, "ES_rate") {
+			return ErrCheckPESHeader
+		}
+		b := data[pos:]
+		if b[0]&0x80 == 0 || b[2]&0x01 == 0 {
+			hdr.addError("ES_rate marker bit error")
+		}
+		hdr.ESRate = uint32(b[0]&0x7f)<<15 | uint32(b[1])<<7 | uint32(b[2]>>1)
+		pos += 3
+	}
+	if hdr.HasTrickMode {
+		if !need(1, "DSM_trick_mode") {
+			return ErrCheckPESHeader
+		}
+		hdr.TrickModeControl = data[pos] >> 5
+		hdr.TrickModeField = data[pos] & 0x1f
+		pos++
+	}
+	if hdr.HasCopyInfo {
+		if !need(1, "additional_copy_info") {
+			return ErrCheckPESHeader
+		}
+		if data[pos]&0x80 == 0 {
+			hdr.addError("additional_copy_info marker bit error")
+		}
+		hdr.AdditionalCopyInfo = data[pos] & 0x7f
+		pos++
+	}
+	if hdr.HasCRC {
+		if !need(2, "previous_PES_packet_CRC") {
+			return ErrCheckPESHeader
+		}
+		hdr.PreviousPESCRC = binary.BigEndian.Uint16(data[pos:])
+		pos += 2
+	}
+	if hdr.HasExtension {
+		n, err := hdr.parseExtension(data[pos:])
+		if err != nil {
+			return err
+		}
+		pos += n
+	}
+	for _, b := range data[pos:] {
+		if b != 0xff {
+			hdr.addError(fmt.Sprintf("stuffing byte 0x%x, should be 0xff", b))
+			break
+		}
+	}
+	hdr.StuffingLength = uint32(len(data) - pos)
+	return nil
+}
+
+// parseExtension 解析PES_extension, 返回用掉的字节数
+func (hdr *PESHeader) parseExtension(data []byte) (int, error) {
+	if len(data) < 1 {
+		hdr.addError("PES_extension needs 1 byte")
+		return 0, ErrCheckPESHeader
+	}
+	flags := data[0]
+	pos := 1
+	need := func(n int, name string) bool {
+		if pos+n > len(data) {
+			hdr.addError(fmt.Sprintf("%s needs %d bytes, header data left %d", name, n, len(data)-pos))
+			return false
+		}
+		return true
+	}
+	if flags&0x80 != 0 {
+		if !need(16, "PES_private_data") {
+			return pos, ErrCheckPESHeader
+		}
+		hdr.PrivateData = data[pos : pos+16]
+		pos += 16
+	}
+	if flags&0x40 != 0 {
+		if !need(1, "pack_field_length") {
+			return pos, ErrCheckPESHeader
+		}
+		n := int(data[pos])
+		pos++
+		if !need(n, "pack_header") {
+			return pos, ErrCheckPESHeader
+		}
+		hdr.PackField = data[pos : pos+n]
+		pos += n
+	}
+	if flags&0x20 != 0 {
+		if !need(2, "program_packet_sequence_counter") {
+			return pos, ErrCheckPESHeader
+		}
+		if data[pos]&0x80 == 0 || data[pos+1]&0x80 == 0 {
+			hdr.addError("program_packet_sequence_counter marker bit error")
+		}
+		hdr.HasSequenceCounter = true
+		hdr.SequenceCounter = data[pos] & 0x7f
+		hdr.MPEG1MPEG2Identifier = data[pos+1]&0x40 != 0
+		hdr.OriginalStuffLength = data[pos+1] & 0x3f
+		pos += 2
+	}
+	if flags&0x10 != 0 {
+		if !need(2, "P-STD_buffer") {
+			return pos, ErrCheckPESHeader
+		}
+		if data[pos]>>6 != 0x01 {
+			hdr.addError("P-STD_buffer start bits error")
+		}
+		hdr.HasPSTDBuffer = true
+		hdr.PSTDBufferScale = data[pos] >> 5 & 0x01
+		hdr.PSTDBufferSize = uint32(binary.BigEndian.Uint16(data[pos:]) & 0x1fff)
+		pos += 2
+	}
+	if flags&0x01 != 0 {
+		if !need(1, "PES_extension_field_length") {
+			return pos, ErrCheckPESHeader
+		}
+		n := int(data[pos] & 0x7f)
+		pos++
+		if !need(n, "PES_extension_field") {
+			return pos, ErrCheckPESHeader
+		}
+		hdr.ExtensionField = data[pos : pos+n]
+		pos += n
+	}
+	return pos, nil
+}
+
+// parseMPEG1 ISO/IEC 11172-1 2.4.3.3 MPEG-1的pes头: 填充字节, STD缓冲区大小, PTS/DTS, 没有标志字节.
+// 返回头的长度, STD缓冲区大小放在PSTDBuffer字段. PTS/DTS不完整时长度按需要的算,
+// 调用的地方据此判断头超出了PES_packet_length
+func (hdr *PESHeader) parseMPEG1(data []byte) (int, error) {
+	hdr.MPEG1 = true
+	pos := 0
+	for pos < len(data) && data[pos] == 0xff {
+		pos++
+	}
+	hdr.StuffingLength = uint32(pos)
+	if pos > 16 {
+		hdr.addError(fmt.Sprintf("stuffing bytes: %d, should be at most 16", pos))
+	}
+	if pos+2 <= len(data) && data[pos]>>6 == 0x01 {
+		hdr.HasPSTDBuffer = true
+		hdr.PSTDBufferScale = data[pos] >> 5 & 0x01
+		hdr.PSTDBufferSize = uint32(data[pos]&0x1f)<<8 | uint32(data[pos+1])
+		pos += 2
+	}
+	if pos >= len(data) {
+		hdr.addError("mpeg1 pes header truncated")
+		hdr.HeaderDataLength = uint32(pos)
+		return pos, ErrCheckPESHeader
+	}
+	switch data[pos] >> 4 {
+	case 0x02:
+		if pos+5 > len(data) {
+			hdr.addError("PTS needs 5 bytes")
+			pos += 5
+			break
+		}
+		hdr.PTSDTSFlags = 2
+		hdr.HasPTS = true
+		hdr.PTS = hdr.parseTimestamp(data[pos:], 0x02, "PTS")
+		pos += 5
+	case 0x03:
+		if pos+10 > len(data) {
+			hdr.addError("PTS and DTS need 10 bytes")
+			pos += 10
+			break
+		}
+		hdr.PTSDTSFlags = 3
+		hdr.HasPTS = true
+		hdr.PTS = hdr.parseTimestamp(data[pos:], 0x03, "PTS")
+		hdr.HasDTS = true
+		hdr.DTS = hdr.parseTimestamp(data[pos+5:], 0x01, "DTS")
+		pos += 10
+	default:
+		if data[pos] != 0x0f {
+			hdr.addError(fmt.Sprintf("mpeg1 pes header byte: 0x%x, should be 0x0f", data[pos]))
+		}
+		pos++
+	}
+	hdr.HeaderDataLength = uint32(pos)
+	if len(hdr.Errors) > 0 {
+		return pos, ErrCheckPESHeader
+	}
+	return pos, nil
+}
+
+// parseTimestamp 5个字节的pts/dts: 4位前缀, 3+15+15位时间戳, 中间3个marker位
+func (hdr *PESHeader) parseTimestamp(b []byte, prefix byte, name string) uint64 {
+	if b[0]>>4 != prefix {
+		hdr.addError(fmt.Sprintf("%s prefix: %d, should be %d", name, b[0]>>4, prefix))
+	}
+	if b[0]&0x01 == 0 || b[2]&0x01 == 0 || b[4]&0x01 == 0 {
+		hdr.addError(name + " marker bit error")
+	}
+	return uint64(b[0]>>1&0x07)<<30 | uint64(b[1])<<22 | uint64(b[2]>>1)<<15 |
+		uint64(b[3])<<7 | uint64(b[4]>>1)
+}
+
+// ptsDiff a-b, 考虑33位的回绕
+func ptsDiff(a, b uint64) int64 {
+	d := (a - b) & ptsMask
+	if d >= ptsHalfMod {
+		return int64(d) - (1 << 33)
+	}
+	return int64(d)
+}
+
+func ptsString(pts uint64) string {
+	return fmt.Sprintf("%d(%.3fs)", pts, float64(pts)/ptsPerSec)
+}
+
+// ptsGap 一个流中相邻两个pts的间隔超过-pts-gap
+type ptsGap struct {
+	pos  int64
+	from uint64
+	to   uint64
+}
+
+// pesTiming 一个基本流的pts/dts检查
+type pesTiming struct {
+	streamID    uint8
+	pesCount    int
+	ptsCount    int
+	dtsCount    int
+	firstPTS    uint64
+	lastPTS     uint64
+	lastDTS     uint64
+	hasLast     bool
+	maxDelta    int64
+	gaps        []ptsGap
+	nonMonotone int
+	repeats     int
+	dtsAfterPTS int
+	errHeaders  int
+}
+
+// update 检查一个pes的时间戳, 有dts时按dts判断是否单调, 因为有B帧时pts本来就不是单调的
+func (t *pesTiming) update(hdr *PESHeader, pos int64, gapLimit int64, verbose bool) {
+	t.pesCount++
+	if len(hdr.Errors) > 0 {
+		t.errHeaders++
+		log.Printf("pes header error, stream id: 0x%x pos: %d(0x%x) %v", hdr.StreamID, pos, pos, hdr.Errors)
+	}
+	if !hdr.HasPTS {
+		return
+	}
+	t.ptsCount++
+	dts := hdr.PTS
+	if hdr.HasDTS {
+		t.dtsCount++
+		dts = hdr.DTS
+		if ptsDiff(hdr.PTS, hdr.DTS) < 0 {
+			t.dtsAfterPTS++
+			log.Printf("dts > pts, stream id: 0x%x pos: %d(0x%x) pts: %s dts: %s",
+				hdr.StreamID, pos, pos, ptsString(hdr.PTS), ptsString(hdr.DTS))
+		}
+	}
+	if !t.hasLast {
+		t.firstPTS = hdr.PTS
+		t.lastPTS = hdr.PTS
+		t.lastDTS = dts
+		t.hasLast = true
+		return
+	}
+	delta := ptsDiff(dts, t.lastDTS)
+	switch {
+	case delta < 0:
+		t.nonMonotone++
+		log.Printf("timestamp goes back, stream id: 0x%x pos: %d(0x%x) last: %s current: %s",
+			hdr.StreamID, pos, pos, ptsString(t.lastDTS), ptsString(dts))
+	case delta == 0:
+		t.repeats++
+		if verbose {
+			log.Printf("timestamp repeats, stream id: 0x%x pos: %d(0x%x) %s", hdr.StreamID, pos, pos, ptsString(dts))
+		}
+	case gapLimit > 0 && delta > gapLimit:
+		t.gaps = append(t.gaps, ptsGap{pos: pos, from: t.lastDTS, to: dts})
+	}
+	if delta > t.maxDelta {
+		t.maxDelta = delta
+	}
+	t.lastPTS = hdr.PTS
+	t.lastDTS = dts
+}
+
+func (t *pesTiming) dump() {
+	log.Printf("stream id: 0x%x", t.streamID)
+	log.Println("\tpes count:", t.pesCount, "with pts:", t.ptsCount, "with dts:", t.dtsCount)
+	if t.errHeaders > 0 {
+		log.Println("\tpes header errors:", t.errHeaders)
+	}
+	if t.ptsCount == 0 {
+		return
+	}
+	log.Println("\tfirst pts:", ptsString(t.firstPTS), "last pts:", ptsString(t.lastPTS),
+		"duration:", fmt.Sprintf("%.3fs", float64(ptsDiff(t.lastPTS, t.firstPTS))/ptsPerSec))
+	log.Printf("\tmax timestamp delta: %.3fms", float64(t.maxDelta)*1000/ptsPerSec)
+	log.Println("\ttimestamp goes back:", t.nonMonotone, "repeats:", t.repeats, "dts > pts:", t.dtsAfterPTS)
+	log.Println("\tpts gap count:", len(t.gaps))
+	for _, gap := range t.gaps {
+		log.Printf("\t\tgap: %s -> %s (%.3fms) pos: %d(0x%x)", ptsString(gap.from), ptsString(gap.to),
+			float64(ptsDiff(gap.to, gap.from))*1000/ptsPerSec, gap.pos, gap.pos)
+	}
+}
+
+// getPesTiming 按stream id取时间戳检查的状态, 第一次见到时创建
+func (dec *PsDecoder) getPesTiming(streamID uint8) *pesTiming {
+	if t, ok := dec.pesTimings[streamID]; ok {
+		return t
+	}
+	t := &pesTiming{streamID: streamID}
+	dec.pesTimings[streamID] = t
+	return t
+}
+
+func (dec *PsDecoder) dumpPesTimings() {
+	ids := make([]int, 0, len(dec.pesTimings))
+	for id := range dec.pesTimings {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		dec.pesTimings[uint8(id)].dump()
+	}
+}
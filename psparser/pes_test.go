@@ -0,0 +1,113 @@
+package psparser
+
+import (
+	"bytes"
+	"dumpPayloadFromRTP/rtptool"
+	"encoding/hex"
+	"testing"
+)
+
+func TestParseMPEG1PESHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		hdrLen   int
+		stuffing uint32
+		hasSTD   bool
+		stdScale uint8
+		stdSize  uint32
+		pts      uint64
+		dts      uint64
+		flags    uint8
+		wantErr  bool
+	}{
+		{name: "no timestamp", data: "0f", hdrLen: 1},
+		{name: "pts", data: "2100379361", hdrLen: 5, pts: 903600, flags: 2},
+		{name: "pts and dts", data: "31003793611100377741", hdrLen: 10, pts: 903600, dts: 900000, flags: 3},
+		{
+			name: "stuffing and std buffer", data: "ffff602e0f",
+			hdrLen: 5, stuffing: 2, hasSTD: true, stdScale: 1, stdSize: 46,
+		},
+		{
+			name: "stuffing, std buffer, pts and dts", data: "ff402e31003793611100377741",
+			hdrLen: 13, stuffing: 1, hasSTD: true, stdScale: 0, stdSize: 46, pts: 903600, dts: 900000, flags: 3,
+		},
+		{name: "too many stuffing bytes", data: "ffffffffffffffffffffffffffffffffff0f", hdrLen: 18, stuffing: 17, wantErr: true},
+		{name: "truncated after stuffing", data: "ffff", hdrLen: 2, stuffing: 2, wantErr: true},
+		{name: "truncated pts", data: "210037", hdrLen: 5, wantErr: true},
+		{name: "bad byte", data: "00", hdrLen: 1, wantErr: true},
+		{name: "pts marker bit", data: "2000379361", hdrLen: 5, pts: 903600, flags: 2, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := hex.DecodeString(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hdr := &PESHeader{}
+			n, err := hdr.parseMPEG1(data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err: %v, errors: %v", err, hdr.Errors)
+			}
+			if n != tt.hdrLen || hdr.HeaderDataLength != uint32(tt.hdrLen) {
+				t.Errorf("header length: got %d/%d, want %d", n, hdr.HeaderDataLength, tt.hdrLen)
+			}
+			if !hdr.MPEG1 || hdr.StuffingLength != tt.stuffing {
+				t.Errorf("stuffing: got %d, want %d", hdr.StuffingLength, tt.stuffing)
+			}
+			if hdr.HasPSTDBuffer != tt.hasSTD || hdr.PSTDBufferScale != tt.stdScale || hdr.PSTDBufferSize != tt.stdSize {
+				t.Errorf("std buffer: got %v %d %d, want %v %d %d", hdr.HasPSTDBuffer, hdr.PSTDBufferScale,
+					hdr.PSTDBufferSize, tt.hasSTD, tt.stdScale, tt.stdSize)
+			}
+			if hdr.PTSDTSFlags != tt.flags || hdr.PTS != tt.pts || hdr.DTS != tt.dts {
+				t.Errorf("timestamp: got flags %d pts %d dts %d, want flags %d pts %d dts %d", hdr.PTSDTSFlags,
+					hdr.PTS, hdr.DTS, tt.flags, tt.pts, tt.dts)
+			}
+		})
+	}
+}
+
+func TestDecodeMPEG1PES(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		payload int
+		wantErr bool
+	}{
+		// PES_packet_length包括pes头
+		{name: "pts", data: "000001e0000821003793610102aa", payload: 3},
+		{name: "std buffer", data: "000001c00006ffff602e0faa", payload: 1},
+		{name: "packet length shorter than header", data: "000001e00003210037936101", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := hex.DecodeString(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dec := newTestDecoder(data)
+			dec.mpeg1 = true
+			startCode, err := dec.br.Read32(32)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hdr, payloadLen, err := dec.decodePESHeader(uint8(startCode))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err: %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if !hdr.MPEG1 || int(payloadLen) != tt.payload {
+				t.Errorf("payload length: got %d, want %d", payloadLen, tt.payload)
+			}
+			if left := int64(len(data)) - dec.getPos(); left != int64(tt.payload) {
+				t.Errorf("left after header: got %d, want %d", left, tt.payload)
+			}
+		})
+	}
+}
+
+func newTestDecoder(data []byte) *PsDecoder {
+	return NewPsDecoder(bytes.NewReader(data), int64(len(data)), &rtptool.ConsoleParam{})
+}
@@ -10,6 +10,7 @@ import (
 	"io"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/giorgisio/goav/avcodec"
 )
@@ -18,6 +19,7 @@ const (
 	StartCodePS    = 0x000001ba
 	StartCodeSYS   = 0x000001bb
 	StartCodeMAP   = 0x000001bc
+	StartCodeEnd   = 0x000001b9
 	StartCodeVideo = 0x000001e0
 	StartCodeAudio = 0x000001c0
 )
@@ -25,6 +27,10 @@ const (
 const (
 	VideoPES = 0x01
 	AudioPES = 0x02
+	// private_stream_1等有pes头, 不输出es的流
+	PrivatePES = 0x03
+	// padding, private_stream_2等没有pes头的流
+	DataPES = 0x04
 )
 
 var (
@@ -50,9 +56,10 @@ type PsDecoder struct {
 	psHeader           map[string]uint32
 	handlers           map[int]func() error
 	psHeaderFields     []FieldInfo
+	mpeg1HeaderFields  []FieldInfo
 	pktCnt             int
-	fileSize           int
-	psBuf              *[]byte
+	fileSize           int64
+	input              *psReader
 	errVideoFrameCnt   int
 	errAudioFrameCnt   int
 	totalVideoFrameCnt int
@@ -64,10 +71,32 @@ type PsDecoder struct {
 	h264File           *os.File
 	audioFile          *os.File
 	param              *rtptool.ConsoleParam
+	pesTimings         map[uint8]*pesTiming
+	av                 *avSync
+	sysHeader          *sysHeaderCheck
+	psm                psmCheck
+	streams            map[uint8]*esStream
+	// 最近一个pack header是MPEG-1的
+	mpeg1        bool
+	mpeg1PackCnt int
+	// -resync时跳过的损坏数据
+	resyncs []psResync
+	// 读到MPEG_program_end_code时停止解析
+	programEnd    bool
+	programEndPos int64
 }
 
 func (dec *PsDecoder) DecodePsPkts() error {
-	for dec.getPos() < int64(dec.fileSize) {
+	for {
+		if data, err := dec.input.PeekAt(dec.getPos(), 4); err == io.EOF {
+			if len(data) > 0 {
+				log.Printf("ignore %d bytes at input end, pos: %d", len(data), dec.getPos())
+			}
+			return nil
+		} else if err != nil {
+			log.Println(err)
+			return err
+		}
 		startCode, err := dec.br.Read32(32)
 		if err != nil {
 			log.Println(err)
@@ -78,31 +107,64 @@ func (dec *PsDecoder) DecodePsPkts() error {
 			fmt.Println()
 			log.Printf("pkt count: %d pos: %d/%d", dec.pktCnt, dec.getPos(), dec.fileSize)
 		}
-		handler, ok := dec.handlers[int(startCode)]
-		if !ok {
+		pktStartPos := dec.getPos() - 4
+		if handler, ok := dec.handlers[int(startCode)]; ok {
+			err = handler()
+		} else if isPESStartCode(startCode) {
+			err = dec.decodeStreamPES(uint8(startCode))
+		} else {
 			log.Printf("check startCode error: 0x%x pos:%d, fileSize:%d\n", startCode, dec.getPos(), dec.fileSize)
-			return ErrParsePakcet
+			if !dec.param.PsResync {
+				log.Println("use -resync to skip damaged data and continue")
+				return ErrParsePakcet
+			}
+			err = fmt.Errorf("unknown start code 0x%x", startCode)
+		}
+		if err != nil && err != ErrDumpDone && dec.param.PsResync {
+			err = dec.resync(pktStartPos, err.Error())
 		}
-		err = handler()
 		if err != nil {
 			return err
 		}
+		if dec.programEnd {
+			return nil
+		}
 	}
-	return nil
 }
 
 func (dec *PsDecoder) decodeSystemHeader() error {
 	br := dec.br
+	sysStartPos := dec.getPos() - 4
 	syslens, err := br.Read32(16)
 	log.Println("=== ps system header === ")
-	if dec.param.PrintSysHeader {
-		log.Printf("\tsystem_header_length:%d", syslens)
-	}
 	if err != nil {
 		return err
 	}
+	data := make([]byte, syslens)
+	if _, err := io.ReadFull(br, data); err != nil {
+		log.Println(err)
+		return err
+	}
+	hdr, _ := parseSystemHeader(data)
+	dec.sysHeader.update(hdr, sysStartPos)
+	if dec.param.PrintSysHeader {
+		b, err := json.MarshalIndent(hdr, "", "  ")
+		if err != nil {
+			log.Println("error:", err)
+		}
+		fmt.Print(string(b) + "\n")
+	}
+	return nil
+}
 
-	br.Skip(uint(syslens) * 8)
+// decodeProgramEnd MPEG_program_end_code, 后面的数据不再解析
+func (dec *PsDecoder) decodeProgramEnd() error {
+	dec.programEnd = true
+	dec.programEndPos = dec.getPos() - 4
+	log.Printf("=== program end === pos: %d(0x%x)", dec.programEndPos, dec.programEndPos)
+	if data, _ := dec.input.PeekAt(dec.getPos(), 1); len(data) > 0 {
+		log.Println("ignore data after program end code")
+	}
 	return nil
 }
 
@@ -111,87 +173,46 @@ func (decoder *PsDecoder) getPos() int64 {
 	return pos
 }
 
-func (decoder *PsDecoder) decodePsmNLoop(programStreamMapLen uint32) error {
-	br := decoder.br
-	for programStreamMapLen > 0 {
-		streamType, err := br.Read32(8)
-		if decoder.param.PrintPsm {
-			log.Printf("\t\tstream type: 0x%x", streamType)
-		}
-		if err != nil {
-			return err
-		}
-		elementaryStreamID, err := br.Read32(8)
-		if err != nil {
-			return err
-		}
-		if elementaryStreamID >= 0xe0 && elementaryStreamID <= 0xef {
-			decoder.videoStreamType = streamType
-		}
-		if elementaryStreamID >= 0xc0 && elementaryStreamID <= 0xdf {
-			decoder.audioStreamType = streamType
-		}
-		if decoder.param.PrintPsm {
-			log.Printf("\t\tstream id: 0x%x", elementaryStreamID)
-		}
-		elementaryStreamInfoLength, err := br.Read32(16)
-		if err != nil {
-			return err
-		}
-		if decoder.param.PrintPsm {
-			log.Printf("\t\telementary_stream_info_length: %d", elementaryStreamInfoLength)
-		}
-		br.Skip(uint(elementaryStreamInfoLength * 8))
-		programStreamMapLen -= (4 + elementaryStreamInfoLength)
-	}
-	return nil
-}
-
 func (dec *PsDecoder) decodeProgramStreamMap() error {
 	br := dec.br
 	dec.psmCnt++
+	psmStartPos := dec.getPos() - 4
 	psmLen, err := br.Read32(16)
 	if err != nil {
 		return err
 	}
 	log.Println("=== program stream map ===")
-	if dec.param.PrintPsm {
-		log.Printf("\tprogram_stream_map_length: %d pos: %d", psmLen, dec.getPos())
-	}
-	//drop psm version info
-	br.Skip(16)
-	psmLen -= 2
-	programStreamInfoLen, err := br.Read32(16)
-	if err != nil {
-		return err
-	}
-	br.Skip(uint(programStreamInfoLen * 8))
-	psmLen -= (programStreamInfoLen + 2)
-	programStreamMapLen, err := br.Read32(16)
-	if err != nil {
+	// crc从start code开始算
+	data := make([]byte, 6+psmLen)
+	binary.BigEndian.PutUint32(data, StartCodeMAP)
+	binary.BigEndian.PutUint16(data[4:], uint16(psmLen))
+	if _, err := io.ReadFull(br, data[6:]); err != nil {
+		log.Println(err)
 		return err
 	}
-	psmLen -= (2 + programStreamMapLen)
+	psm, err := parsePSM(data)
 	if dec.param.PrintPsm {
-		log.Printf("\tprogram_stream_info_length: %d", programStreamMapLen)
+		b, err := json.MarshalIndent(psm, "", "  ")
+		if err != nil {
+			log.Println("error:", err)
+		}
+		fmt.Print(string(b) + "\n")
 	}
-
-	if err := dec.decodePsmNLoop(programStreamMapLen); err != nil {
-		return err
+	if !dec.psm.update(psm, err, psmStartPos) {
+		return nil
 	}
-
-	// crc 32
-	if psmLen != 4 {
-		if dec.param.PrintPsm {
-			log.Printf("psmLen: 0x%x", psmLen)
+	for _, es := range psm.ElementaryStreams {
+		if isVideoStreamID(es.StreamID) {
+			dec.videoStreamType = uint32(es.StreamType)
+		}
+		if isAudioStreamID(es.StreamID) {
+			dec.audioStreamType = uint32(es.StreamType)
 		}
-		return ErrFormatPack
 	}
-	br.Skip(32)
 	return nil
 }
 
-func (dec *PsDecoder) decodeH264(data []byte, len uint32, err bool) error {
+func (dec *PsDecoder) decodeH264(stream *esStream, data []byte, len uint32, err bool) error {
 	codec := avcodec.AvcodecFindDecoderByName("h264")
 	if codec == nil {
 		log.Println("find codec err")
@@ -219,43 +240,44 @@ func (dec *PsDecoder) decodeH264(data []byte, len uint32, err bool) error {
 			dec.pFrameCnt++
 		}
 	}
-	if !err && dec.h264File != nil {
-		return dec.writeH264FrameToFile(data)
+	if !err && stream.file != nil {
+		return dec.writeH264FrameToFile(stream, data)
 	}
 	return nil
 }
 
-func (dec *PsDecoder) saveAudioPkt(data []byte, len uint32, err bool) error {
+func (dec *PsDecoder) saveAudioPkt(stream *esStream, data []byte, len uint32, err bool) error {
 	if dec.param.Verbose {
 		log.Printf("\t\taudio len : %d", len)
 	}
-	if !err && dec.audioFile != nil {
-		dec.writeAudioFrameToFile(data)
+	if !err && stream.file != nil {
+		return dec.writeAudioFrameToFile(stream.file, data)
 	}
 	return nil
 }
 
 func (dec *PsDecoder) isStartCodeValid(startCode uint32) bool {
-	if startCode == StartCodePS ||
+	return startCode == StartCodePS ||
 		startCode == StartCodeMAP ||
 		startCode == StartCodeSYS ||
-		startCode == StartCodeVideo ||
-		startCode == StartCodeAudio {
-		return true
-	}
-	return false
+		startCode == StartCodeEnd ||
+		isPESStartCode(startCode)
 }
 
 // 移动到当前位置+payloadLen位置，判断startcode是否正确
 // 如果startcode不正确，说明payloadLen是错误的
 func (dec *PsDecoder) isPayloadLenValid(payloadLen uint32, pesType int, pesStartPos int64) bool {
-	psBuf := *dec.psBuf
 	pos := dec.getPos() + int64(payloadLen)
-	if pos >= int64(dec.fileSize) {
+	buf, err := dec.input.PeekAt(pos, 4)
+	if err == io.EOF && len(buf) == 0 {
+		// 最后一个pes正好到输入结束
+		return true
+	}
+	if err != nil {
 		log.Printf("reach file end, quit, pos: %d filesize: %d\n", pos, dec.fileSize)
 		return false
 	}
-	packStartCode := binary.BigEndian.Uint32(psBuf[pos : pos+4])
+	packStartCode := binary.BigEndian.Uint32(buf)
 	if !dec.isStartCodeValid(packStartCode) {
 		log.Printf("check payload len error, len: %d pes start pos: %d(0x%x), pesType:%d", payloadLen, pesStartPos, pesStartPos, pesType)
 		return false
@@ -263,29 +285,39 @@ func (dec *PsDecoder) isPayloadLenValid(payloadLen uint32, pesType int, pesStart
 	return true
 }
 
-func (dec *PsDecoder) GetNextPackPos() int {
-	pos := int(dec.getPos())
-	for pos < dec.fileSize-4 {
-		b := (*dec.psBuf)[pos : pos+4]
+// GetNextPackPos 从当前位置往后找下一个start code, 最多找maxScanLen个字节,
+// 找不到时返回输入结束的位置
+func (dec *PsDecoder) GetNextPackPos() int64 {
+	pos := dec.getPos()
+	end := pos + maxScanLen
+	for pos+4 <= end {
+		b, err := dec.input.PeekAt(pos, 4)
+		if err != nil {
+			return pos + int64(len(b))
+		}
 		packStartCode := binary.BigEndian.Uint32(b)
 		if dec.isStartCodeValid((packStartCode)) {
 			return pos
 		}
 		pos++
 	}
-	return dec.fileSize
+	log.Printf("not found start code in %d bytes, pos: %d", maxScanLen, dec.getPos())
+	return end
 }
 
-func (dec *PsDecoder) skipInvalidBytes(payloadLen uint32, pesType int, pesStartPos int64) error {
-	if pesType == VideoPES {
+func (dec *PsDecoder) skipInvalidBytes(stream *esStream, payloadLen uint32, pesStartPos int64) error {
+	stream.errCount++
+	switch stream.pesType {
+	case VideoPES:
 		dec.errVideoFrameCnt++
-	} else {
+	case AudioPES:
 		dec.errAudioFrameCnt++
 	}
 	br := dec.br
 	pos := dec.GetNextPackPos()
-	skipLen := pos - int(dec.getPos())
-	log.Printf("pes start dump: % X\n", (*dec.psBuf)[pesStartPos:pesStartPos+16])
+	skipLen := int(pos - dec.getPos())
+	pesStart, _ := dec.input.PeekAt(pesStartPos, 16)
+	log.Printf("pes start dump: % X\n", pesStart)
 	log.Printf("pes payload len err, expect: %d actual: %d", payloadLen, skipLen)
 	log.Printf("skip len: %d, next pack pos:%d", skipLen, pos)
 	skipBuf := make([]byte, skipLen)
@@ -294,86 +326,177 @@ func (dec *PsDecoder) skipInvalidBytes(payloadLen uint32, pesType int, pesStartP
 		log.Println(err)
 		return err
 	}
-	if pesType == AudioPES {
-		dec.saveAudioPkt(skipBuf, uint32(skipLen), true)
-	} else {
-		return dec.decodeH264(skipBuf, uint32(skipLen), true)
+	switch stream.pesType {
+	case AudioPES:
+		dec.saveAudioPkt(stream, skipBuf, uint32(skipLen), true)
+	case VideoPES:
+		return dec.decodeH264(stream, skipBuf, uint32(skipLen), true)
 	}
 	return nil
 }
 
-func (dec *PsDecoder) decodeAudioPes() error {
+func (dec *PsDecoder) decodeAudioPes(streamID uint8) error {
 	if dec.param.Verbose {
-		log.Println("=== Audio ===")
+		log.Printf("=== Audio 0x%x ===", streamID)
 	}
 	dec.totalAudioFrameCnt++
-	dec.decodePES(AudioPES)
-	return nil
+	return dec.decodePES(AudioPES, streamID)
 }
 
-func (dec *PsDecoder) decodePESHeader() (uint32, error) {
+func (dec *PsDecoder) decodePESHeader(streamID uint8) (*PESHeader, uint32, error) {
 	br := dec.br
+	hdr := &PESHeader{StreamID: streamID}
 	/* payload length */
 	payloadLen, err := br.Read32(16)
 	if err != nil {
 		log.Println(err)
-		return 0, err
+		return nil, 0, err
+	}
+	hdr.PacketLength = payloadLen
+	// MPEG-1的pes头没有'10'开头的标志字节
+	if dec.mpeg1 {
+		if bits, err := br.Peek8(2); err == nil && bits != 0x02 {
+			return dec.decodeMPEG1PESHeader(hdr, payloadLen)
+		}
 	}
 
 	/* flags: pts_dts_flags ... */
-	br.Skip(16) // 跳过各种flags,比如pts_dts_flags
+	flags, err := br.Read16(16)
+	if err != nil {
+		log.Println(err)
+		return nil, 0, err
+	}
+	hdr.parseFlags(flags)
 	payloadLen -= 2
 
 	/* pes header data length */
 	pesHeaderDataLen, err := br.Read32(8)
 	if err != nil {
 		log.Println(err)
-		return 0, err
+		return nil, 0, err
 	}
+	hdr.HeaderDataLength = pesHeaderDataLen
 	if dec.param.Verbose {
 		log.Printf("\tPES_packet_length: %d", payloadLen)
 		log.Printf("\tpes_header_data_length: %d", pesHeaderDataLen)
 	}
+	// PES_packet_length为0或者比pes头还短, 减下去会回绕成很大的数
+	if hdr.PacketLength < 3+pesHeaderDataLen {
+		log.Printf("PES_packet_length: %d shorter than pes header: %d, pos: %d", hdr.PacketLength,
+			3+pesHeaderDataLen, dec.getPos())
+		return hdr, 0, ErrCheckPayloadLen
+	}
 	payloadLen--
 
 	/* pes header data */
-	br.Skip(uint(pesHeaderDataLen * 8))
+	data := make([]byte, pesHeaderDataLen)
+	if _, err := io.ReadFull(br, data); err != nil {
+		log.Println(err)
+		return nil, 0, err
+	}
+	if err := hdr.parseData(data); err != nil {
+		log.Printf("parse pes header data error: %v pos: %d", hdr.Errors, dec.getPos())
+	}
+	dec.printPESHeader(hdr)
 	payloadLen -= pesHeaderDataLen
-	return payloadLen, nil
+	return hdr, payloadLen, nil
+}
+
+// decodeMPEG1PESHeader ISO/IEC 11172-1的pes头, 长度不固定, 先预读再按解析出的长度读走
+func (dec *PsDecoder) decodeMPEG1PESHeader(hdr *PESHeader, payloadLen uint32) (*PESHeader, uint32, error) {
+	n := int(payloadLen)
+	if n > maxMPEG1PESHeaderLen {
+		n = maxMPEG1PESHeaderLen
+	}
+	data, err := dec.input.PeekAt(dec.getPos(), n)
+	if err != nil && err != io.EOF {
+		log.Println(err)
+		return nil, 0, err
+	}
+	hdrLen, err := hdr.parseMPEG1(data)
+	if err != nil {
+		log.Printf("parse mpeg1 pes header error: %v pos: %d", hdr.Errors, dec.getPos())
+		// 头在PES_packet_length之内没有结束
+		if hdrLen >= int(payloadLen) {
+			return hdr, 0, ErrCheckPayloadLen
+		}
+	}
+	if _, err := io.ReadFull(dec.br, make([]byte, hdrLen)); err != nil {
+		log.Println(err)
+		return nil, 0, err
+	}
+	if dec.param.Verbose {
+		log.Printf("\tPES_packet_length: %d", payloadLen)
+		log.Printf("\tmpeg1 pes header length: %d", hdrLen)
+	}
+	dec.printPESHeader(hdr)
+	return hdr, payloadLen - uint32(hdrLen), nil
 }
 
-func (dec *PsDecoder) decodePES(pesType int) error {
+func (dec *PsDecoder) printPESHeader(hdr *PESHeader) {
+	if dec.param.Verbose {
+		if hdr.HasPTS {
+			log.Println("\tPTS:", ptsString(hdr.PTS))
+		}
+		if hdr.HasDTS {
+			log.Println("\tDTS:", ptsString(hdr.DTS))
+		}
+	}
+	if dec.param.PrintPesHeader {
+		b, err := json.MarshalIndent(hdr, "", "  ")
+		if err != nil {
+			log.Println("error:", err)
+		}
+		fmt.Print(string(b) + "\n")
+	}
+}
+
+func (dec *PsDecoder) decodePES(pesType int, streamID uint8) error {
 	br := dec.br
 	pesStartPos := dec.getPos() - 4 // 4为startcode的长度
 	if dec.param.DumpPesStartBytes {
-		log.Printf("% X\n", (*dec.psBuf)[pesStartPos:pesStartPos+16])
+		pesStart, _ := dec.input.PeekAt(pesStartPos, 16)
+		log.Printf("% X\n", pesStart)
+	}
+	hdr, payloadLen, err := dec.decodePESHeader(streamID)
+	if err == ErrCheckPayloadLen {
+		return dec.skipInvalidBytes(dec.getStream(streamID, pesType), hdr.PacketLength, pesStartPos)
 	}
-	payloadLen, err := dec.decodePESHeader()
 	if err != nil {
 		return err
 	}
+	dec.getPesTiming(streamID).update(hdr, pesStartPos, int64(dec.param.PtsGap.Seconds()*ptsPerSec), dec.param.Verbose)
+	dec.sysHeader.addPES(streamID, hdr.PacketLength, pesStartPos)
+	if err := dec.av.addPES(hdr, pesStartPos); err != nil {
+		return err
+	}
+	stream := dec.getStream(streamID, pesType)
 	if !dec.isPayloadLenValid(payloadLen, pesType, pesStartPos) {
-		return dec.skipInvalidBytes(payloadLen, pesType, pesStartPos)
+		return dec.skipInvalidBytes(stream, payloadLen, pesStartPos)
 	}
 	payloadData := make([]byte, payloadLen)
 	if _, err := io.ReadAtLeast(br, payloadData, int(payloadLen)); err != nil {
 		return err
 	}
-	if pesType == VideoPES {
-		return dec.decodeH264(payloadData, payloadLen, false)
-	} else {
-		dec.saveAudioPkt(payloadData, payloadLen, false)
+	stream.pesCount++
+	stream.bytes += int64(payloadLen)
+	switch pesType {
+	case VideoPES:
+		return dec.decodeH264(stream, payloadData, payloadLen, false)
+	case AudioPES:
+		return dec.saveAudioPkt(stream, payloadData, payloadLen, false)
 	}
 
 	return nil
 }
 
-func (dec *PsDecoder) decodeVideoPes() error {
+func (dec *PsDecoder) decodeVideoPes(streamID uint8) error {
 	if dec.param.Verbose {
-		log.Println("=== video ===")
+		log.Printf("=== video 0x%x ===", streamID)
 	}
-	err := dec.decodePES(VideoPES)
+	err := dec.decodePES(VideoPES, streamID)
 	dec.totalVideoFrameCnt++
+	dec.getStream(streamID, VideoPES).frameCnt++
 	return err
 }
 
@@ -381,7 +504,16 @@ func (decoder *PsDecoder) decodePsHeader() error {
 	if decoder.param.Verbose {
 		log.Println("=== pack header ===")
 	}
+	packStartPos := decoder.getPos() - 4
+	// MPEG-1的pack header以'0010'开头, MPEG-2的以'01'开头
 	psHeaderFields := decoder.psHeaderFields
+	decoder.mpeg1 = false
+	if prefix, err := decoder.br.Peek8(4); err == nil && prefix == 0x02 {
+		psHeaderFields = decoder.mpeg1HeaderFields
+		decoder.mpeg1 = true
+		decoder.mpeg1PackCnt++
+	}
+	decoder.psHeader = make(map[string]uint32)
 	for _, field := range psHeaderFields {
 		val, err := decoder.br.Read32(field.len)
 		if err != nil {
@@ -390,6 +522,16 @@ func (decoder *PsDecoder) decodePsHeader() error {
 		}
 		decoder.psHeader[field.item] = val
 	}
+	// 重新同步时不认前缀和marker位不对的pack header, 多半是负载里碰巧出现的start code
+	if decoder.param.PsResync && !decoder.isPsHeaderValid(psHeaderFields) {
+		log.Printf("pack header marker bit error, pos: %d(0x%x)", packStartPos, packStartPos)
+		return ErrFormatPack
+	}
+	scr := uint64(decoder.psHeader["system_clock_refrence_base1"])<<30 |
+		uint64(decoder.psHeader["system_clock_refrence_base2"])<<15 |
+		uint64(decoder.psHeader["system_clock_refrence_base3"])
+	decoder.av.updateSCR(scr, packStartPos)
+	decoder.sysHeader.updateMuxRate(decoder.psHeader["program_mux_rate"])
 	pack_stuffing_length := decoder.psHeader["pack_stuffing_length"]
 	decoder.br.Skip(uint(pack_stuffing_length * 8))
 	if decoder.param.PrintPsHeader {
@@ -402,24 +544,53 @@ func (decoder *PsDecoder) decodePsHeader() error {
 	return nil
 }
 
-func (dec *PsDecoder) writeH264FrameToFile(frame []byte) error {
-	if dec.totalVideoFrameCnt > dec.param.DumpVideoFrameCnt {
-		return ErrDumpDone
+func (decoder *PsDecoder) isPsHeaderValid(fields []FieldInfo) bool {
+	fixed := uint32(0x01)
+	if decoder.mpeg1 {
+		fixed = 0x02
+	}
+	if decoder.psHeader["fixed"] != fixed {
+		return false
+	}
+	for _, field := range fields {
+		if strings.HasPrefix(field.item, "marker_bit") && decoder.psHeader[field.item] != 1 {
+			return false
+		}
 	}
-	if _, err := dec.h264File.Write(frame); err != nil {
+	return true
+}
+
+// writeH264FrameToFile -dump-video-frame-cnt按每个视频流算, 所有视频流都写够了才结束
+func (dec *PsDecoder) writeH264FrameToFile(stream *esStream, frame []byte) error {
+	if stream.frameCnt > dec.param.DumpVideoFrameCnt {
+		if dec.isVideoDumpDone() {
+			return ErrDumpDone
+		}
+		return nil
+	}
+	if _, err := stream.file.Write(frame); err != nil {
 		log.Println(err)
 		return err
 	}
-	dec.h264File.Sync()
+	stream.file.Sync()
 	return nil
 }
 
-func (dec *PsDecoder) writeAudioFrameToFile(frame []byte) error {
-	if _, err := dec.audioFile.Write(frame); err != nil {
+func (dec *PsDecoder) isVideoDumpDone() bool {
+	for _, stream := range dec.streams {
+		if stream.pesType == VideoPES && stream.file != nil && stream.frameCnt <= dec.param.DumpVideoFrameCnt {
+			return false
+		}
+	}
+	return true
+}
+
+func (dec *PsDecoder) writeAudioFrameToFile(file *os.File, frame []byte) error {
+	if _, err := file.Write(frame); err != nil {
 		log.Println(err)
 		return err
 	}
-	dec.audioFile.Sync()
+	file.Sync()
 	return nil
 }
 
@@ -443,22 +614,31 @@ func (dec *PsDecoder) openAudioFile() error {
 	return nil
 }
 
-func NewPsDecoder(br bitreader.BitReader, psBuf *[]byte, fileSize int, param *rtptool.ConsoleParam) *PsDecoder {
+// NewPsDecoder 从r中边读边解析, 只缓存有限的数据, fileSize只用来打印, 不知道时为0
+func NewPsDecoder(r io.Reader, fileSize int64, param *rtptool.ConsoleParam) *PsDecoder {
+	input := newPsReader(r)
 	decoder := &PsDecoder{
-		br:             br,
+		br:             bitreader.NewReader(input),
 		psHeader:       make(map[string]uint32),
 		handlers:       make(map[int]func() error),
 		psHeaderFields: make([]FieldInfo, 14),
 		fileSize:       fileSize,
-		psBuf:          psBuf,
+		input:          input,
 		param:          param,
+		pesTimings:     map[uint8]*pesTiming{},
+		sysHeader:      newSysHeaderCheck(),
+		streams:        map[uint8]*esStream{},
 	}
+	av, err := newAVSync(param.AvSyncFile, param.AvJump.Seconds()*1000)
+	if err != nil {
+		return nil
+	}
+	decoder.av = av
 	decoder.handlers = map[int]func() error{
-		StartCodePS:    decoder.decodePsHeader,
-		StartCodeSYS:   decoder.decodeSystemHeader,
-		StartCodeMAP:   decoder.decodeProgramStreamMap,
-		StartCodeVideo: decoder.decodeVideoPes,
-		StartCodeAudio: decoder.decodeAudioPes,
+		StartCodePS:  decoder.decodePsHeader,
+		StartCodeSYS: decoder.decodeSystemHeader,
+		StartCodeMAP: decoder.decodeProgramStreamMap,
+		StartCodeEnd: decoder.decodeProgramEnd,
 	}
 	decoder.psHeaderFields = []FieldInfo{
 		{2, "fixed"},
@@ -476,6 +656,19 @@ func NewPsDecoder(br bitreader.BitReader, psBuf *[]byte, fileSize int, param *rt
 		{5, "reserved"},
 		{3, "pack_stuffing_length"},
 	}
+	// ISO/IEC 11172-1 2.4.3.2, 没有SCR扩展和填充长度
+	decoder.mpeg1HeaderFields = []FieldInfo{
+		{4, "fixed"},
+		{3, "system_clock_refrence_base1"},
+		{1, "marker_bit1"},
+		{15, "system_clock_refrence_base2"},
+		{1, "marker_bit2"},
+		{15, "system_clock_refrence_base3"},
+		{1, "marker_bit3"},
+		{1, "marker_bit4"},
+		{22, "program_mux_rate"},
+		{1, "marker_bit5"},
+	}
 	if param.DumpAudio {
 		err := decoder.openAudioFile()
 		if err != nil {
@@ -497,9 +690,27 @@ func (dec *PsDecoder) ShowInfo() {
 	log.Printf("err frame cont: %d\n", dec.errVideoFrameCnt)
 	log.Printf("I frame count: %d\n", dec.iFrameCnt)
 	log.Printf("err I frame count: %d\n", dec.errIFrameCnt)
+	if dec.mpeg1PackCnt > 0 {
+		log.Printf("mpeg1 pack header count: %d", dec.mpeg1PackCnt)
+	}
 	log.Printf("program stream map count: %d", dec.psmCnt)
+	dec.psm.dump()
 	log.Printf("P frame count: %d\n", dec.pFrameCnt)
 	log.Println("total audio frame count:", dec.totalAudioFrameCnt)
 	log.Printf("video stream type: 0x%x\n", dec.videoStreamType)
 	log.Printf("audio stream type: 0x%x\n", dec.audioStreamType)
+	if dec.programEnd {
+		log.Printf("program end code pos: %d(0x%x)", dec.programEndPos, dec.programEndPos)
+	}
+	dec.dumpStreams()
+	dec.dumpResyncs()
+	dec.dumpPesTimings()
+	dec.sysHeader.dump()
+	dec.av.dump()
+}
+
+// Close 解析结束, 写完A/V同步的时间序列
+func (dec *PsDecoder) Close() {
+	dec.av.close()
+	dec.closeStreams()
 }
@@ -0,0 +1,98 @@
+package psparser
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestDecodePackHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		mpeg1   bool
+		scr     [3]uint32
+		muxRate uint32
+		size    int64
+	}{
+		{
+			// SCR 0x123456789, program_mux_rate 10843
+			name: "mpeg1", data: "000001ba298d15cf138054b7", mpeg1: true,
+			scr: [3]uint32{4, 18058, 26505}, muxRate: 10843, size: 12,
+		},
+		{
+			name: "mpeg2", data: "000001ba4400040004010189c3f8",
+			muxRate: 25200, size: 14,
+		},
+		{
+			// pack_stuffing_length为2, 跳过后面两个填充字节
+			name: "mpeg2 stuffing", data: "000001ba4400040004010189c3faffff",
+			muxRate: 25200, size: 16,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := hex.DecodeString(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !validPackHeader(data) {
+				t.Error("validPackHeader: got false")
+			}
+			dec := newTestDecoder(data)
+			if _, err := dec.br.Read32(32); err != nil {
+				t.Fatal(err)
+			}
+			if err := dec.decodePsHeader(); err != nil {
+				t.Fatal(err)
+			}
+			if dec.mpeg1 != tt.mpeg1 {
+				t.Errorf("mpeg1: got %v, want %v", dec.mpeg1, tt.mpeg1)
+			}
+			fields := dec.psHeaderFields
+			if tt.mpeg1 {
+				fields = dec.mpeg1HeaderFields
+			}
+			if !dec.isPsHeaderValid(fields) {
+				t.Errorf("marker bits: %v", dec.psHeader)
+			}
+			scr := [3]uint32{dec.psHeader["system_clock_refrence_base1"], dec.psHeader["system_clock_refrence_base2"],
+				dec.psHeader["system_clock_refrence_base3"]}
+			if scr != tt.scr {
+				t.Errorf("scr: got %v, want %v", scr, tt.scr)
+			}
+			if dec.psHeader["program_mux_rate"] != tt.muxRate {
+				t.Errorf("program_mux_rate: got %d, want %d", dec.psHeader["program_mux_rate"], tt.muxRate)
+			}
+			if dec.getPos() != tt.size {
+				t.Errorf("pos after pack header: got %d, want %d", dec.getPos(), tt.size)
+			}
+		})
+	}
+}
+
+func TestValidPackHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want bool
+	}{
+		{"mpeg1", "000001ba298d15cf138054b7", true},
+		{"mpeg1 marker bit", "000001ba288d15cf138054b7", false},
+		{"mpeg1 mux rate marker", "000001ba298d15cf130054b7", false},
+		{"mpeg2", "000001ba4400040004010189c3f8", true},
+		{"mpeg2 marker bit", "000001ba4000040004010189c3f8", false},
+		{"mpeg2 too short", "000001ba4400040004010189c3", false},
+		{"unknown prefix", "000001ba0000040004010189c3f8", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := hex.DecodeString(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := validPackHeader(data); got != tt.want {
+				t.Errorf("validPackHeader: got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
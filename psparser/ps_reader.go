@@ -0,0 +1,120 @@
+package psparser
+
+import (
+	"errors"
+	"io"
+)
+
+const (
+	// 已经读过的数据往回保留的字节数, bitreader会预读8个字节, pes头最长9+255个字节
+	keepBehind = 1024
+	// 读过的数据超过这个大小时从缓冲里丢掉
+	compactSize = 256 * 1024
+	// 每次从输入读的最小字节数
+	readChunkSize = 32 * 1024
+	// payload长度错误时, 最多往后找多少字节的start code
+	maxScanLen = 4 * 1024 * 1024
+)
+
+var (
+	ErrPeekBehind = errors.New("peek position already dropped")
+	ErrPeekTooFar = errors.New("peek position too far ahead")
+)
+
+// psReader 在io.Reader上加一个有限的缓冲, 记录读到的位置, 支持往后预读,
+// 输入可以是文件, 管道或者socket. 实现bitreader.ByteReader:
+// Size是已经从输入读到的字节数, Len是其中还没被读走的字节数, Size-Len就是当前位置
+type psReader struct {
+	r   io.Reader
+	buf []byte
+	// buf[0]在输入中的偏移
+	base int64
+	// 下一个要读走的字节在输入中的偏移
+	pos int64
+	// 输入返回的错误, 读完是io.EOF
+	err error
+}
+
+func newPsReader(r io.Reader) *psReader {
+	return &psReader{r: r}
+}
+
+func (pr *psReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if pr.Len() == 0 {
+		pr.fill(pr.pos + int64(len(p)))
+		if pr.Len() == 0 {
+			return 0, pr.err
+		}
+	}
+	n := copy(p, pr.buf[pr.pos-pr.base:])
+	pr.pos += int64(n)
+	pr.compact()
+	return n, nil
+}
+
+func (pr *psReader) Len() int {
+	return int(pr.Size() - pr.pos)
+}
+
+func (pr *psReader) Size() int64 {
+	return pr.base + int64(len(pr.buf))
+}
+
+// PeekAt 返回输入中从off开始的n个字节, 不移动读的位置.
+// 输入不够n个字节时返回剩下的字节和输入的错误. 最多往后看maxScanLen个字节, 缓冲不会超过这个大小
+func (pr *psReader) PeekAt(off int64, n int) ([]byte, error) {
+	if off < pr.base {
+		return nil, ErrPeekBehind
+	}
+	if off+int64(n)-pr.pos > maxScanLen {
+		return nil, ErrPeekTooFar
+	}
+	err := pr.fill(off + int64(n))
+	if off >= pr.Size() {
+		return nil, err
+	}
+	start := off - pr.base
+	end := start + int64(n)
+	if end > int64(len(pr.buf)) {
+		end = int64(len(pr.buf))
+	}
+	return pr.buf[start:end], err
+}
+
+// fill 从输入读到end为止, 输入出错时返回错误
+func (pr *psReader) fill(end int64) error {
+	for pr.Size() < end && pr.err == nil {
+		need := int(end - pr.Size())
+		if need < readChunkSize {
+			need = readChunkSize
+		}
+		old := len(pr.buf)
+		if cap(pr.buf)-old < need {
+			buf := make([]byte, old, old+need)
+			copy(buf, pr.buf)
+			pr.buf = buf
+		}
+		n, err := pr.r.Read(pr.buf[old : old+need])
+		pr.buf = pr.buf[:old+n]
+		pr.err = err
+	}
+	if pr.Size() < end {
+		return pr.err
+	}
+	return nil
+}
+
+// compact 丢掉读过很久的数据, 只往回保留keepBehind个字节
+func (pr *psReader) compact() {
+	consumed := pr.pos - pr.base
+	if consumed < compactSize+keepBehind {
+		return
+	}
+	drop := consumed - keepBehind
+	n := copy(pr.buf, pr.buf[drop:])
+	pr.buf = pr.buf[:n]
+	pr.base += drop
+}
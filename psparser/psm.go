@@ -0,0 +1,332 @@
+package psparser
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+)
+
+var ErrCheckPSM = errors.New("check program stream map error")
+
+// ISO/IEC 13818-1 2.6 描述符的名字, 只列常见的
+var descriptorNames = map[uint8]string{
+	0x02: "video_stream_descriptor",
+	0x03: "audio_stream_descriptor",
+	0x04: "hierarchy_descriptor",
+	0x05: "registration_descriptor",
+	0x06: "data_stream_alignment_descriptor",
+	0x07: "target_background_grid_descriptor",
+	0x08: "video_window_descriptor",
+	0x09: "CA_descriptor",
+	0x0a: "ISO_639_language_descriptor",
+	0x0b: "system_clock_descriptor",
+	0x0c: "multiplex_buffer_utilization_descriptor",
+	0x0d: "copyright_descriptor",
+	0x0e: "maximum_bitrate_descriptor",
+	0x0f: "private_data_indicator_descriptor",
+	0x10: "smoothing_buffer_descriptor",
+	0x11: "STD_descriptor",
+	0x12: "IBP_descriptor",
+	0x1b: "MPEG-4_video_descriptor",
+	0x1c: "MPEG-4_audio_descriptor",
+	0x28: "AVC_video_descriptor",
+	0x2a: "AVC_timing_and_HRD_descriptor",
+	0x38: "HEVC_video_descriptor",
+}
+
+// ISO/IEC 13818-1 表2-45, 64~255是用户私有的描述符, 各厂商的含义不同, 只打印原始数据
+const userPrivateDescriptorTag = 0x40
+
+func descriptorName(tag uint8) string {
+	if name, ok := descriptorNames[tag]; ok {
+		return name
+	}
+	if tag >= userPrivateDescriptorTag {
+		return fmt.Sprintf("user private (0x%02x)", tag)
+	}
+	return "unknown"
+}
+
+// Descriptor psm里的一个描述符, Fields是认识的描述符解析出来的字段
+type Descriptor struct {
+	Tag    uint8
+	Name   string
+	Length uint8
+	Fields map[string]interface{} `json:",omitempty"`
+	Data   string
+}
+
+// ElementaryStreamInfo psm里一个基本流的映射
+type ElementaryStreamInfo struct {
+	StreamType  uint8
+	StreamID    uint8
+	InfoLength  uint16
+	Descriptors []Descriptor `json:",omitempty"`
+}
+
+// ProgramStreamMap ISO/IEC 13818-1 2.5.4 program stream map
+type ProgramStreamMap struct {
+	Length                  uint16
+	CurrentNextIndicator    bool
+	SingleExtensionStream   bool
+	Version                 uint8
+	ProgramStreamInfoLength uint16
+	Descriptors             []Descriptor `json:",omitempty"`
+	ElementaryStreamsLength uint16
+	ElementaryStreams       []ElementaryStreamInfo
+	CRC                     uint32
+	CRCOK                   bool
+	// 长度, marker位等错误
+	Errors []string `json:",omitempty"`
+}
+
+func (psm *ProgramStreamMap) addError(msg string) {
+	psm.Errors = append(psm.Errors, msg)
+}
+
+// crc32MPEG ISO/IEC 13818-1 附录A的CRC-32, 多项式0x04c11db7, 不反转, 初值全1.
+// 包括CRC字段一起算时结果为0
+func crc32MPEG(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// parsePSM 解析整个psm, data从start code开始, 包括最后4个字节的CRC
+func parsePSM(data []byte) (*ProgramStreamMap, error) {
+	psm := &ProgramStreamMap{Length: binary.BigEndian.Uint16(data[4:])}
+	body := data[6:]
+	if len(body) < 10 {
+		psm.addError(fmt.Sprintf("program_stream_map_length: %d, should be at least 10", len(body)))
+		return psm, ErrCheckPSM
+	}
+	psm.CurrentNextIndicator = body[0]&0x80 != 0
+	psm.SingleExtensionStream = body[0]&0x40 != 0
+	psm.Version = body[0] & 0x1f
+	if body[1]&0x01 == 0 {
+		psm.addError("marker bit error")
+	}
+	psm.ProgramStreamInfoLength = binary.BigEndian.Uint16(body[2:])
+	pos := 4
+	end := pos + int(psm.ProgramStreamInfoLength)
+	if end+2 > len(body)-4 {
+		psm.addError(fmt.Sprintf("program_stream_info_length: %d, too long", psm.ProgramStreamInfoLength))
+		return psm, ErrCheckPSM
+	}
+	psm.Descriptors = psm.parseDescriptors(body[pos:end])
+	pos = end
+	psm.ElementaryStreamsLength = binary.BigEndian.Uint16(body[pos:])
+	pos += 2
+	end = pos + int(psm.ElementaryStreamsLength)
+	if end != len(body)-4 {
+		psm.addError(fmt.Sprintf("elementary_stream_map_length: %d, %d bytes left before crc",
+			psm.ElementaryStreamsLength, len(body)-4-pos))
+		return psm, ErrCheckPSM
+	}
+	for pos < end {
+		if pos+4 > end {
+			psm.addError(fmt.Sprintf("elementary stream info needs 4 bytes, left %d", end-pos))
+			return psm, ErrCheckPSM
+		}
+		es := ElementaryStreamInfo{
+			StreamType: body[pos],
+			StreamID:   body[pos+1],
+			InfoLength: binary.BigEndian.Uint16(body[pos+2:]),
+		}
+		pos += 4
+		if pos+int(es.InfoLength) > end {
+			psm.addError(fmt.Sprintf("stream id 0x%x: elementary_stream_info_length: %d, left %d",
+				es.StreamID, es.InfoLength, end-pos))
+			return psm, ErrCheckPSM
+		}
+		es.Descriptors = psm.parseDescriptors(body[pos : pos+int(es.InfoLength)])
+		pos += int(es.InfoLength)
+		psm.ElementaryStreams = append(psm.ElementaryStreams, es)
+	}
+	psm.CRC = binary.BigEndian.Uint32(body[len(body)-4:])
+	psm.CRCOK = crc32MPEG(data) == 0
+	if !psm.CRCOK {
+		psm.addError(fmt.Sprintf("crc: 0x%08x, should be 0x%08x", psm.CRC, crc32MPEG(data[:len(data)-4])))
+	}
+	return psm, nil
+}
+
+// parseDescriptors 解析一段描述符, 长度不对时剩下的部分不解析
+func (psm *ProgramStreamMap) parseDescriptors(data []byte) []Descriptor {
+	var descs []Descriptor
+	for pos := 0; pos < len(data); {
+		if pos+2 > len(data) || pos+2+int(data[pos+1]) > len(data) {
+			psm.addError(fmt.Sprintf("descriptor length error, %d bytes left", len(data)-pos))
+			break
+		}
+		desc := Descriptor{Tag: data[pos], Length: data[pos+1]}
+		payload := data[pos+2 : pos+2+int(desc.Length)]
+		desc.Name = descriptorName(desc.Tag)
+		desc.Fields = parseDescriptorFields(desc.Tag, payload)
+		desc.Data = hex.EncodeToString(payload)
+		descs = append(descs, desc)
+		pos += 2 + int(desc.Length)
+	}
+	return descs
+}
+
+// parseDescriptorFields 解析认识的描述符, 长度不够时返回nil, 只保留原始数据
+func parseDescriptorFields(tag uint8, b []byte) map[string]interface{} {
+	switch {
+	case tag == 0x02 && len(b) >= 1:
+		fields := map[string]interface{}{
+			"multiple_frame_rate_flag":   b[0]&0x80 != 0,
+			"frame_rate_code":            b[0] >> 3 & 0x0f,
+			"MPEG_1_only_flag":           b[0]&0x04 != 0,
+			"constrained_parameter_flag": b[0]&0x02 != 0,
+			"still_picture_flag":         b[0]&0x01 != 0,
+		}
+		if b[0]&0x04 == 0 && len(b) >= 3 {
+			fields["profile_and_level_indication"] = b[1]
+			fields["chroma_format"] = b[2] >> 6
+			fields["frame_rate_extension_flag"] = b[2]&0x20 != 0
+		}
+		return fields
+	case tag == 0x03 && len(b) >= 1:
+		return map[string]interface{}{
+			"free_format_flag":              b[0]&0x80 != 0,
+			"ID":                            b[0] >> 6 & 0x01,
+			"layer":                         b[0] >> 4 & 0x03,
+			"variable_rate_audio_indicator": b[0]&0x08 != 0,
+		}
+	case tag == 0x05 && len(b) >= 4:
+		return map[string]interface{}{
+			"format_identifier":              string(b[:4]),
+			"additional_identification_info": hex.EncodeToString(b[4:]),
+		}
+	case tag == 0x0a:
+		var langs []map[string]interface{}
+		for i := 0; i+4 <= len(b); i += 4 {
+			langs = append(langs, map[string]interface{}{
+				"ISO_639_language_code": string(b[i : i+3]),
+				"audio_type":            b[i+3],
+			})
+		}
+		return map[string]interface{}{"languages": langs}
+	case tag == 0x28 && len(b) >= 4:
+		return map[string]interface{}{
+			"profile_idc":                   b[0],
+			"constraint_set_flags":          b[1] >> 2,
+			"AVC_compatible_flags":          b[1] & 0x03,
+			"level_idc":                     b[2],
+			"AVC_still_present":             b[3]&0x80 != 0,
+			"AVC_24_hour_picture_flag":      b[3]&0x40 != 0,
+			"frame_packing_SEI_not_present": b[3]&0x20 != 0,
+		}
+	case tag == 0x38 && len(b) >= 13:
+		return map[string]interface{}{
+			"profile_space":                    b[0] >> 6,
+			"tier_flag":                        b[0] >> 5 & 0x01,
+			"profile_idc":                      b[0] & 0x1f,
+			"profile_compatibility_indication": binary.BigEndian.Uint32(b[1:]),
+			"progressive_source_flag":          b[5]&0x80 != 0,
+			"interlaced_source_flag":           b[5]&0x40 != 0,
+			"level_idc":                        b[11],
+			"temporal_layer_subset_flag":       b[12]&0x80 != 0,
+			"HEVC_still_present_flag":          b[12]&0x40 != 0,
+			"HEVC_24hr_picture_present_flag":   b[12]&0x20 != 0,
+		}
+	}
+	return nil
+}
+
+// psmEvent 流中间psm的变化
+type psmEvent struct {
+	pos  int64
+	desc string
+}
+
+// psmCheck 检查psm的CRC和版本变化
+type psmCheck struct {
+	last      *ProgramStreamMap
+	errs      int
+	crcErrs   int
+	notActive int
+	events    []psmEvent
+}
+
+// update 每个psm调用一次, 返回这个psm是否应该生效, 长度不对解析不完的不生效
+func (c *psmCheck) update(psm *ProgramStreamMap, err error, pos int64) bool {
+	if err != nil {
+		c.errs++
+		log.Printf("program stream map error, pos: %d(0x%x) %v", pos, pos, psm.Errors)
+		return false
+	}
+	if len(psm.Errors) > 0 {
+		c.errs++
+		log.Printf("program stream map error, pos: %d(0x%x) %v", pos, pos, psm.Errors)
+	}
+	// 不少设备不填CRC, CRC不对时仍然按这个psm解析
+	if !psm.CRCOK {
+		c.crcErrs++
+	}
+	if !psm.CurrentNextIndicator {
+		// 还没生效的psm, 下一个current_next_indicator为1的才生效
+		c.notActive++
+		c.addEvent(pos, fmt.Sprintf("next map, version: %d, not applicable yet", psm.Version))
+		return false
+	}
+	last := c.last
+	c.last = psm
+	if last == nil {
+		return true
+	}
+	sameStreams := reflect.DeepEqual(last.ElementaryStreams, psm.ElementaryStreams) &&
+		reflect.DeepEqual(last.Descriptors, psm.Descriptors)
+	switch {
+	case last.Version != psm.Version && sameStreams:
+		c.addEvent(pos, fmt.Sprintf("version %d -> %d, streams not changed", last.Version, psm.Version))
+	case last.Version != psm.Version:
+		c.addEvent(pos, fmt.Sprintf("version %d -> %d, streams: %s -> %s", last.Version, psm.Version,
+			psmStreams(last), psmStreams(psm)))
+	case !sameStreams:
+		c.addEvent(pos, fmt.Sprintf("changed without version change (%d), streams: %s -> %s", psm.Version,
+			psmStreams(last), psmStreams(psm)))
+	}
+	return true
+}
+
+func (c *psmCheck) addEvent(pos int64, desc string) {
+	log.Printf("program stream map changed, pos: %d(0x%x) %s", pos, pos, desc)
+	c.events = append(c.events, psmEvent{pos: pos, desc: desc})
+}
+
+// psmStreams 打印用的基本流列表, 例如 [0xe0:0x1b 0xc0:0x90]
+func psmStreams(psm *ProgramStreamMap) string {
+	s := "["
+	for i, es := range psm.ElementaryStreams {
+		if i > 0 {
+			s += " "
+		}
+		s += fmt.Sprintf("0x%x:0x%x", es.StreamID, es.StreamType)
+	}
+	return s + "]"
+}
+
+func (c *psmCheck) dump() {
+	log.Println("program stream map errors:", c.errs, "crc errors:", c.crcErrs, "not applicable:", c.notActive)
+	if c.last != nil {
+		log.Println("\tlast version:", c.last.Version, "streams(id:type):", psmStreams(c.last))
+	}
+	log.Println("\tprogram stream map change events:", len(c.events))
+	for _, event := range c.events {
+		log.Printf("\t\t%s pos: %d(0x%x)", event.desc, event.pos, event.pos)
+	}
+}
@@ -0,0 +1,70 @@
+package psparser
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// GB28181常见的psm: H.264(0xe0) + G.711A(0xc0), 没有描述符
+const testPSM = "000001bc0012e0ff000000081be0000090c00000fedfb1d7"
+
+func TestCRC32MPEG(t *testing.T) {
+	psm, _ := hex.DecodeString(testPSM)
+	tests := []struct {
+		name string
+		data []byte
+		want uint32
+	}{
+		// CRC-32/MPEG-2的标准校验值
+		{"check value", []byte("123456789"), 0x0376e6e7},
+		{"empty", nil, 0xffffffff},
+		{"psm without crc", psm[:len(psm)-4], 0xfedfb1d7},
+		{"psm with crc", psm, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := crc32MPEG(tt.data); got != tt.want {
+				t.Errorf("crc32MPEG: got 0x%08x, want 0x%08x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePSMCRC(t *testing.T) {
+	good, _ := hex.DecodeString(testPSM)
+	tests := []struct {
+		name  string
+		flip  int
+		crcOK bool
+	}{
+		{"good", -1, true},
+		{"bad stream type", 12, false},
+		{"bad crc", len(good) - 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := append([]byte(nil), good...)
+			if tt.flip >= 0 {
+				data[tt.flip] ^= 0x01
+			}
+			// crc错误记在Errors里, 不影响解析
+			psm, err := parsePSM(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if psm.CRCOK != tt.crcOK || (len(psm.Errors) == 0) != tt.crcOK {
+				t.Fatalf("got crc ok: %v errors: %v, want crc ok: %v", psm.CRCOK, psm.Errors, tt.crcOK)
+			}
+			want := uint32(0xfedfb1d7)
+			if tt.flip == len(good)-1 {
+				want ^= 0x01
+			}
+			if psm.CRC != want {
+				t.Errorf("crc field: got 0x%08x, want 0x%08x", psm.CRC, want)
+			}
+			if len(psm.ElementaryStreams) != 2 || psm.ElementaryStreams[1].StreamID != 0xc0 {
+				t.Errorf("elementary streams: got %+v", psm.ElementaryStreams)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package psparser
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+)
+
+// 重新同步时每次往后看多少字节
+const resyncChunkSize = 64 * 1024
+
+var packStartCode = []byte{0x00, 0x00, 0x01, 0xba}
+
+// psResync 一段损坏的数据, 从pos开始跳过了length个字节
+type psResync struct {
+	pos    int64
+	length int64
+	reason string
+}
+
+// validPackHeader 检查pack header的前缀和marker位, 避免把负载里碰巧出现的00 00 01 ba当成pack header.
+// MPEG-2以'01'开头, MPEG-1以'0010'开头
+func validPackHeader(b []byte) bool {
+	if len(b) >= 12 && b[4]>>4 == 0x02 {
+		return b[4]&0x01 != 0 && b[6]&0x01 != 0 && b[8]&0x01 != 0 && b[9]&0x80 != 0 && b[11]&0x01 != 0
+	}
+	if len(b) < 14 {
+		return false
+	}
+	return b[4]>>6 == 0x01 && b[4]&0x04 != 0 && b[6]&0x04 != 0 && b[8]&0x04 != 0 &&
+		b[9]&0x01 != 0 && b[12]&0x03 == 0x03
+}
+
+// resync 从当前位置往后找下一个合法的pack header, 跳过中间的数据后继续解析.
+// start是出错的包开始的位置, 已经读过的数据不再找. 找不到时跳到输入结束
+func (dec *PsDecoder) resync(start int64, reason string) error {
+	pos := dec.getPos()
+	next := int64(-1)
+	for next < 0 {
+		data, err := dec.input.PeekAt(pos, resyncChunkSize)
+		if err != nil && err != io.EOF {
+			log.Println(err)
+			return err
+		}
+		// 下一次从哪里开始找, 留3个字节给跨两块的start code
+		scanned := pos + int64(len(data)) - 3
+		for off := 0; ; {
+			i := bytes.Index(data[off:], packStartCode)
+			if i < 0 {
+				break
+			}
+			i += off
+			if len(data)-i < 14 && err == nil {
+				// pack header不完整, 下一块从这里开始, MPEG-1的只有12个字节, 这里按长的算
+				scanned = pos + int64(i)
+				break
+			}
+			if validPackHeader(data[i:]) {
+				next = pos + int64(i)
+				break
+			}
+			off = i + 1
+		}
+		if next >= 0 {
+			break
+		}
+		if err == io.EOF {
+			next = pos + int64(len(data))
+			break
+		}
+		if err := dec.skipTo(scanned); err != nil {
+			return err
+		}
+		pos = scanned
+	}
+	if err := dec.skipTo(next); err != nil {
+		return err
+	}
+	r := psResync{pos: start, length: next - start, reason: reason}
+	dec.resyncs = append(dec.resyncs, r)
+	log.Printf("resync, skip %d bytes from pos: %d(0x%x) to %d(0x%x), reason: %s", r.length, start, start, next, next, reason)
+	return nil
+}
+
+// skipTo 丢掉当前位置到pos之间的数据
+func (dec *PsDecoder) skipTo(pos int64) error {
+	n := pos - dec.getPos()
+	if n <= 0 {
+		return nil
+	}
+	if _, err := io.CopyN(ioutil.Discard, dec.br, n); err != nil && err != io.EOF {
+		log.Println(err)
+		return err
+	}
+	return nil
+}
+
+func (dec *PsDecoder) dumpResyncs() {
+	if !dec.param.PsResync {
+		return
+	}
+	var skipped int64
+	for _, r := range dec.resyncs {
+		skipped += r.length
+	}
+	fmt.Println()
+	log.Println("resync count:", len(dec.resyncs), "skipped bytes:", skipped)
+	for _, r := range dec.resyncs {
+		log.Printf("\tpos: %d(0x%x) len: %d reason: %s", r.pos, r.pos, r.length, r.reason)
+	}
+}
@@ -0,0 +1,162 @@
+package psparser
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+)
+
+// ISO/IEC 13818-1 表2-22 stream id
+const (
+	streamIDPrivate1  = 0xbd
+	streamIDPadding   = 0xbe
+	streamIDPrivate2  = 0xbf
+	streamIDECM       = 0xf0
+	streamIDEMM       = 0xf1
+	streamIDDSMCC     = 0xf2
+	streamIDH2221E    = 0xf8
+	streamIDDirectory = 0xff
+)
+
+// esStream 一个stream id的统计和输出文件
+type esStream struct {
+	id       uint8
+	pesType  int
+	pesCount int
+	errCount int
+	bytes    int64
+	// 视频流的帧数, -dump-video-frame-cnt按每个流单独算
+	frameCnt int
+	file     *os.File
+}
+
+func isPESStartCode(startCode uint32) bool {
+	return startCode>>8 == 1 && startCode&0xff >= streamIDPrivate1
+}
+
+// hasPESHeader padding, private_stream_2等流的长度之后直接是数据, 没有pes头的标志和可选字段
+func hasPESHeader(streamID uint8) bool {
+	switch streamID {
+	case StartCodeMAP & 0xff, streamIDPadding, streamIDPrivate2, streamIDECM, streamIDEMM,
+		streamIDDSMCC, streamIDH2221E, streamIDDirectory:
+		return false
+	}
+	return true
+}
+
+func pesTypeName(pesType int) string {
+	switch pesType {
+	case VideoPES:
+		return "video"
+	case AudioPES:
+		return "audio"
+	case PrivatePES:
+		return "private"
+	}
+	return "data"
+}
+
+// decodeStreamPES 按stream id的范围分发, 不只是0xe0和0xc0
+func (dec *PsDecoder) decodeStreamPES(streamID uint8) error {
+	switch {
+	case isVideoStreamID(streamID):
+		return dec.decodeVideoPes(streamID)
+	case isAudioStreamID(streamID):
+		return dec.decodeAudioPes(streamID)
+	case hasPESHeader(streamID):
+		if dec.param.Verbose {
+			log.Printf("=== stream 0x%x ===", streamID)
+		}
+		return dec.decodePES(PrivatePES, streamID)
+	}
+	return dec.decodeDataPES(streamID)
+}
+
+// decodeDataPES 跳过没有pes头的流, padding的长度也按这个跳过
+func (dec *PsDecoder) decodeDataPES(streamID uint8) error {
+	pesStartPos := dec.getPos() - 4
+	payloadLen, err := dec.br.Read32(16)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if dec.param.Verbose {
+		log.Printf("=== stream 0x%x === PES_packet_length: %d", streamID, payloadLen)
+	}
+	stream := dec.getStream(streamID, DataPES)
+	if !dec.isPayloadLenValid(payloadLen, DataPES, pesStartPos) {
+		return dec.skipInvalidBytes(stream, payloadLen, pesStartPos)
+	}
+	data := make([]byte, payloadLen)
+	if _, err := io.ReadFull(dec.br, data); err != nil {
+		log.Println(err)
+		return err
+	}
+	stream.pesCount++
+	stream.bytes += int64(payloadLen)
+	return nil
+}
+
+// getStream 按stream id取流的状态, 第一次见到时创建
+func (dec *PsDecoder) getStream(streamID uint8, pesType int) *esStream {
+	if stream, ok := dec.streams[streamID]; ok {
+		return stream
+	}
+	stream := &esStream{id: streamID, pesType: pesType}
+	switch pesType {
+	case VideoPES:
+		stream.file = dec.streamFile(dec.h264File, dec.param.OutputVideoFile, pesType, streamID)
+	case AudioPES:
+		stream.file = dec.streamFile(dec.audioFile, dec.param.OutputAudioFile, pesType, streamID)
+	}
+	dec.streams[streamID] = stream
+	return stream
+}
+
+// streamFile 第一个视频/音频流写到-output-video/-output-audio,
+// 之后的流写到文件名加上stream id的文件, 例如output.video.e1
+func (dec *PsDecoder) streamFile(first *os.File, name string, pesType int, streamID uint8) *os.File {
+	if first == nil {
+		return nil
+	}
+	for _, stream := range dec.streams {
+		if stream.pesType == pesType && stream.file == first {
+			f, err := os.OpenFile(fmt.Sprintf("%s.%x", name, streamID), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+			if err != nil {
+				log.Println(err)
+				return nil
+			}
+			return f
+		}
+	}
+	return first
+}
+
+func (dec *PsDecoder) dumpStreams() {
+	ids := make([]int, 0, len(dec.streams))
+	for id := range dec.streams {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	log.Println("stream count:", len(ids))
+	for _, id := range ids {
+		stream := dec.streams[uint8(id)]
+		output := ""
+		if stream.file != nil {
+			output = "output: " + stream.file.Name()
+		}
+		log.Printf("\tstream id: 0x%x %s pes: %d err: %d bytes: %d %s", id, pesTypeName(stream.pesType),
+			stream.pesCount, stream.errCount, stream.bytes, output)
+	}
+}
+
+// closeStreams 关闭每个流的输出文件
+func (dec *PsDecoder) closeStreams() {
+	for _, stream := range dec.streams {
+		if stream.file != nil && stream.file != dec.h264File && stream.file != dec.audioFile {
+			stream.file.Close()
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package psparser
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+)
+
+// system header里代表所有音频流和所有视频流的stream id
+const (
+	streamIDAllAudio = 0xb8
+	streamIDAllVideo = 0xb9
+)
+
+var ErrCheckSystemHeader = errors.New("check system header error")
+
+// SystemHeaderStream system header里一个流的P-STD缓冲区上限
+type SystemHeaderStream struct {
+	StreamID             uint8
+	PSTDBufferBoundScale uint8
+	PSTDBufferSizeBound  uint32
+	// 按scale换算成字节, scale为0时单位128字节, 为1时单位1024字节
+	BufferBoundBytes uint32
+}
+
+// SystemHeader ISO/IEC 13818-1 2.5.3.5 system header
+type SystemHeader struct {
+	HeaderLength          uint32
+	RateBound             uint32
+	AudioBound            uint8
+	FixedFlag             bool
+	CSPSFlag              bool
+	SystemAudioLockFlag   bool
+	SystemVideoLockFlag   bool
+	VideoBound            uint8
+	PacketRateRestriction bool
+	Streams               []SystemHeaderStream
+	// marker位等错误
+	Errors []string `json:",omitempty"`
+}
+
+func (hdr *SystemHeader) addError(msg string) {
+	hdr.Errors = append(hdr.Errors, msg)
+}
+
+// parseSystemHeader 解析header_length之后的部分
+func parseSystemHeader(data []byte) (*SystemHeader, error) {
+	hdr := &SystemHeader{HeaderLength: uint32(len(data))}
+	if len(data) < 6 {
+		hdr.addError(fmt.Sprintf("header length: %d, should be at least 6", len(data)))
+		return hdr, ErrCheckSystemHeader
+	}
+	if data[0]&0x80 == 0 || data[2]&0x01 == 0 || data[4]&0x20 == 0 {
+		hdr.addError("marker bit error")
+	}
+	hdr.RateBound = uint32(data[0]&0x7f)<<15 | uint32(data[1])<<7 | uint32(data[2]>>1)
+	hdr.AudioBound = data[3] >> 2
+	hdr.FixedFlag = data[3]&0x02 != 0
+	hdr.CSPSFlag = data[3]&0x01 != 0
+	hdr.SystemAudioLockFlag = data[4]&0x80 != 0
+	hdr.SystemVideoLockFlag = data[4]&0x40 != 0
+	hdr.VideoBound = data[4] & 0x1f
+	hdr.PacketRateRestriction = data[5]&0x80 != 0
+	if hdr.AudioBound > 32 {
+		hdr.addError(fmt.Sprintf("audio_bound: %d, should be 0~32", hdr.AudioBound))
+	}
+	if hdr.VideoBound > 16 {
+		hdr.addError(fmt.Sprintf("video_bound: %d, should be 0~16", hdr.VideoBound))
+	}
+	pos := 6
+	// 第一位是1时后面是一个流的信息
+	for pos < len(data) && data[pos]&0x80 != 0 {
+		if pos+3 > len(data) {
+			hdr.addError(fmt.Sprintf("stream info needs 3 bytes, left %d", len(data)-pos))
+			return hdr, ErrCheckSystemHeader
+		}
+		stream := SystemHeaderStream{
+			StreamID:             data[pos],
+			PSTDBufferBoundScale: data[pos+1] >> 5 & 0x01,
+			PSTDBufferSizeBound:  uint32(data[pos+1]&0x1f)<<8 | uint32(data[pos+2]),
+		}
+		if data[pos+1]>>6 != 0x03 {
+			hdr.addError(fmt.Sprintf("stream id 0x%x: bits after stream id should be '11'", stream.StreamID))
+		}
+		if stream.StreamID < 0xbc && stream.StreamID != streamIDAllAudio && stream.StreamID != streamIDAllVideo {
+			hdr.addError(fmt.Sprintf("stream id 0x%x is not a valid stream id", stream.StreamID))
+		}
+		if stream.PSTDBufferBoundScale == 0 {
+			stream.BufferBoundBytes = stream.PSTDBufferSizeBound * 128
+		} else {
+			stream.BufferBoundBytes = stream.PSTDBufferSizeBound * 1024
+		}
+		hdr.Streams = append(hdr.Streams, stream)
+		pos += 3
+	}
+	if pos != len(data) {
+		hdr.addError(fmt.Sprintf("%d bytes left after stream info", len(data)-pos))
+	}
+	if len(hdr.Errors) > 0 {
+		return hdr, ErrCheckSystemHeader
+	}
+	return hdr, nil
+}
+
+// bufferBound 一个流的P-STD缓冲区上限, 没有单独列出时用0xb8/0xb9的
+func (hdr *SystemHeader) bufferBound(streamID uint8) (uint32, bool) {
+	var all uint32
+	found := false
+	for _, stream := range hdr.Streams {
+		switch {
+		case stream.StreamID == streamID:
+			return stream.BufferBoundBytes, true
+		case stream.StreamID == streamIDAllAudio && isAudioStreamID(streamID),
+			stream.StreamID == streamIDAllVideo && isVideoStreamID(streamID):
+			all = stream.BufferBoundBytes
+			found = true
+		}
+	}
+	return all, found
+}
+
+func isAudioStreamID(streamID uint8) bool {
+	return streamID >= 0xc0 && streamID <= 0xdf
+}
+
+func isVideoStreamID(streamID uint8) bool {
+	return streamID >= 0xe0 && streamID <= 0xef
+}
+
+// sysHeaderCheck 用文件里实际出现的流检查system header声明的上限
+type sysHeaderCheck struct {
+	hdr     *SystemHeader
+	count   int
+	errs    int
+	changes int
+	// 每个流最大的pes包, 包括6个字节的start code和长度
+	maxPES      map[uint8]uint32
+	maxMuxRate  uint32
+	overBuffers map[uint8]int
+}
+
+func newSysHeaderCheck() *sysHeaderCheck {
+	return &sysHeaderCheck{maxPES: map[uint8]uint32{}, overBuffers: map[uint8]int{}}
+}
+
+// update 每个system header调用一次, 同一个ps里的system header应该完全相同
+func (c *sysHeaderCheck) update(hdr *SystemHeader, pos int64) {
+	c.count++
+	if len(hdr.Errors) > 0 {
+		c.errs++
+		log.Printf("system header error, pos: %d(0x%x) %v", pos, pos, hdr.Errors)
+	}
+	if c.hdr != nil && !reflect.DeepEqual(c.hdr, hdr) {
+		c.changes++
+		log.Printf("system header changed, pos: %d(0x%x)", pos, pos)
+	}
+	c.hdr = hdr
+}
+
+func (c *sysHeaderCheck) updateMuxRate(rate uint32) {
+	if rate > c.maxMuxRate {
+		c.maxMuxRate = rate
+	}
+}
+
+func (c *sysHeaderCheck) addPES(streamID uint8, packetLength uint32, pos int64) {
+	size := packetLength + 6
+	if size > c.maxPES[streamID] {
+		c.maxPES[streamID] = size
+	}
+	if c.hdr == nil {
+		return
+	}
+	if bound, ok := c.hdr.bufferBound(streamID); ok && size > bound {
+		c.overBuffers[streamID]++
+		if c.overBuffers[streamID] == 1 {
+			log.Printf("pes larger than P-STD buffer bound, stream id: 0x%x pos: %d(0x%x) size: %d bound: %d",
+				streamID, pos, pos, size, bound)
+		}
+	}
+}
+
+// dump 打印最后一个system header和检查的结果
+func (c *sysHeaderCheck) dump() {
+	fmt.Println()
+	log.Println("system header count:", c.count, "errors:", c.errs, "changes:", c.changes)
+	if c.hdr == nil {
+		return
+	}
+	hdr := c.hdr
+	log.Println("\trate_bound:", hdr.RateBound, "audio_bound:", hdr.AudioBound, "video_bound:", hdr.VideoBound,
+		"fixed:", hdr.FixedFlag, "CSPS:", hdr.CSPSFlag, "audio lock:", hdr.SystemAudioLockFlag,
+		"video lock:", hdr.SystemVideoLockFlag)
+	ids := make([]int, 0, len(c.maxPES))
+	audios, videos := 0, 0
+	for id := range c.maxPES {
+		ids = append(ids, int(id))
+		if isAudioStreamID(id) {
+			audios++
+		}
+		if isVideoStreamID(id) {
+			videos++
+		}
+	}
+	sort.Ints(ids)
+	if audios > int(hdr.AudioBound) {
+		log.Println("\taudio streams:", audios, "more than audio_bound:", hdr.AudioBound)
+	}
+	if videos > int(hdr.VideoBound) {
+		log.Println("\tvideo streams:", videos, "more than video_bound:", hdr.VideoBound)
+	}
+	if c.maxMuxRate > hdr.RateBound {
+		log.Println("\tprogram_mux_rate:", c.maxMuxRate, "more than rate_bound:", hdr.RateBound)
+	}
+	for _, id := range ids {
+		bound, ok := hdr.bufferBound(uint8(id))
+		if !ok {
+			log.Printf("\tstream id 0x%x not in system header", id)
+			continue
+		}
+		log.Printf("\tstream id 0x%x max pes: %d buffer bound: %d over bound: %d", id, c.maxPES[uint8(id)],
+			bound, c.overBuffers[uint8(id)])
+	}
+	for _, stream := range hdr.Streams {
+		if stream.StreamID == streamIDAllAudio || stream.StreamID == streamIDAllVideo {
+			continue
+		}
+		if _, ok := c.maxPES[stream.StreamID]; !ok {
+			log.Printf("\tstream id 0x%x in system header but not found", stream.StreamID)
+		}
+	}
+}
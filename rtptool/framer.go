@@ -0,0 +1,461 @@
+package rtptool
+
+import (
+	"bufio"
+	"bytes"
+	"dumpPayloadFromRTP/pcapparser"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"time"
+)
+
+const (
+	FramingAuto = "auto"
+	// RFC 4571, 每个rtp包前面有2个字节的长度, GB28181 tcp
+	FramingTCP = "tcp"
+	// 一个udp报文就是一个rtp包, 没有长度前缀
+	FramingUDP = "udp"
+)
+
+const rtpdumpMagic = "#!rtpplay1.0 "
+
+// 没有csrc和扩展头的rtp头长度
+const rtpHeaderLen = 12
+
+var (
+	ErrUnknowFraming = errors.New("unknown framing")
+	ErrCheckRtpdump  = errors.New("check rtpdump file error")
+)
+
+// Frame 输入中切出来的一个完整的rtp包, 不带长度前缀
+type Frame struct {
+	Data []byte
+	// 这个包在输入文件中的偏移, tcp是长度前缀的位置, 抓包文件是记录的位置
+	Offset int64
+	// 抓包时间, 输入没有时间信息时为零值
+	Timestamp time.Time
+}
+
+// Framer 把输入切分成一个个rtp包, 读完返回io.EOF
+type Framer interface {
+	ReadFrame() (*Frame, error)
+	// Framing 输入的封装方式, FramingTCP或FramingUDP
+	Framing() string
+}
+
+// NewFramer 根据framing参数创建Framer, auto时根据文件头自动检测:
+// pcap/pcapng按流的传输层协议, rtpdump按udp, 其他的按rfc4571的tcp负载处理
+func NewFramer(r io.Reader, framing string, pcapStream int) (Framer, error) {
+	br := bufio.NewReader(r)
+	hdr, _ := br.Peek(len(rtpdumpMagic))
+	switch framing {
+	case FramingAuto, FramingTCP, FramingUDP:
+	default:
+		log.Println("unknown framing:", framing)
+		return nil, ErrUnknowFraming
+	}
+	if pcapparser.IsPcap(hdr) {
+		return newPcapFramer(br, framing, pcapStream)
+	}
+	isRtpdump := bytes.HasPrefix(hdr, []byte(rtpdumpMagic))
+	if framing == FramingUDP || (framing == FramingAuto && isRtpdump) {
+		if !isRtpdump {
+			log.Println("udp framing need pcap or rtpdump file")
+			return nil, ErrCheckRtpdump
+		}
+		return newRtpdumpFramer(br)
+	}
+	return &tcpFramer{r: br}, nil
+}
+
+// tcpFramer RFC 4571, 2个字节的长度 + rtp包
+type tcpFramer struct {
+	r   io.Reader
+	pos int64
+	// 实时接收时用收到的时间作为包的时间
+	live bool
+}
+
+func (f *tcpFramer) Framing() string {
+	return FramingTCP
+}
+
+func (f *tcpFramer) ReadFrame() (*Frame, error) {
+	lenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(f.r, lenBuf); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			log.Println("truncated rtp len at pos:", f.pos)
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	rtpLen := binary.BigEndian.Uint16(lenBuf)
+	frame := &Frame{
+		Data:   make([]byte, rtpLen),
+		Offset: f.pos,
+	}
+	n, err := io.ReadFull(f.r, frame.Data)
+	if f.live {
+		frame.Timestamp = time.Now()
+	}
+	f.pos += 2 + int64(n)
+	if err != nil {
+		log.Println("truncated rtp at pos:", frame.Offset, "rtp len:", rtpLen, "read:", n)
+		return nil, io.EOF
+	}
+	return frame, nil
+}
+
+// rtpdumpFramer rtptools的rtpdump格式, 每条记录是一个udp报文
+type rtpdumpFramer struct {
+	r     *bufio.Reader
+	pos   int64
+	start time.Time
+}
+
+func newRtpdumpFramer(r *bufio.Reader) (*rtpdumpFramer, error) {
+	// #!rtpplay1.0 address/port\n
+	line, err := r.ReadString('\n')
+	if err != nil {
+		log.Println("read rtpdump header err:", err)
+		return nil, ErrCheckRtpdump
+	}
+	// RD_hdr_t: start.tv_sec(4) start.tv_usec(4) source(4) port(2) padding(2)
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		log.Println("read rtpdump header err:", err)
+		return nil, ErrCheckRtpdump
+	}
+	sec := binary.BigEndian.Uint32(hdr[0:])
+	usec := binary.BigEndian.Uint32(hdr[4:])
+	return &rtpdumpFramer{
+		r:     r,
+		pos:   int64(len(line) + len(hdr)),
+		start: time.Unix(int64(sec), int64(usec)*1000),
+	}, nil
+}
+
+func (f *rtpdumpFramer) Framing() string {
+	return FramingUDP
+}
+
+func (f *rtpdumpFramer) ReadFrame() (*Frame, error) {
+	for {
+		// RD_packet_t: length(2) plen(2) offset(4), length包含这8个字节
+		hdr := make([]byte, 8)
+		if _, err := io.ReadFull(f.r, hdr); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+		recLen := int(binary.BigEndian.Uint16(hdr[0:]))
+		plen := int(binary.BigEndian.Uint16(hdr[2:]))
+		offsetMs := binary.BigEndian.Uint32(hdr[4:])
+		if recLen < 8 {
+			log.Println("check rtpdump record len error, len:", recLen, "pos:", f.pos)
+			return nil, ErrCheckRtpdump
+		}
+		frame := &Frame{
+			Data:      make([]byte, recLen-8),
+			Offset:    f.pos,
+			Timestamp: f.start.Add(time.Duration(offsetMs) * time.Millisecond),
+		}
+		if _, err := io.ReadFull(f.r, frame.Data); err != nil {
+			log.Println("truncated rtpdump record at pos:", f.pos)
+			return nil, io.EOF
+		}
+		f.pos += int64(recLen)
+		// plen为0的是rtcp, 或者只dump了头部
+		if plen == 0 {
+			if isRTCP(frame.Data) {
+				return frame, nil
+			}
+			continue
+		}
+		if plen < len(frame.Data) {
+			frame.Data = frame.Data[:plen]
+		}
+		return frame, nil
+	}
+}
+
+// pcapFramer 从抓包文件中选出一条rtp流, tcp的流重组后按rfc4571切分, udp的流一个报文一个包.
+// 同时收集相关的rtcp: 反方向的流, udp时还有端口+1的rtcp流
+type pcapFramer struct {
+	reader  *pcapparser.Reader
+	framing string
+	index   int
+	seen    map[pcapparser.Flow]bool
+	flow    *pcapparser.Flow
+	// 选中的流和相关的流, tcp的流有各自的重组状态, udp为nil
+	related map[pcapparser.Flow]*tcpSplitter
+	frames  []*Frame
+	eof     bool
+}
+
+func newPcapFramer(r io.Reader, framing string, index int) (*pcapFramer, error) {
+	reader, err := pcapparser.NewReader(r)
+	if err != nil {
+		log.Println("read pcap err:", err)
+		return nil, err
+	}
+	return &pcapFramer{
+		reader:  reader,
+		framing: framing,
+		index:   index,
+		seen:    map[pcapparser.Flow]bool{},
+	}, nil
+}
+
+func (f *pcapFramer) Framing() string {
+	if f.flow != nil && f.flow.Proto == pcapparser.ProtoUDP {
+		return FramingUDP
+	}
+	return FramingTCP
+}
+
+// 判断是否是要找的rtp流, 按出现的顺序计数
+func (f *pcapFramer) selectFlow(pkt *pcapparser.Packet) bool {
+	if f.seen[pkt.Flow] {
+		return false
+	}
+	switch pkt.Flow.Proto {
+	case pcapparser.ProtoTCP:
+		if f.framing == FramingUDP || !pcapparser.LooksLikeRTPOverTCP(pkt.Payload) {
+			return false
+		}
+	case pcapparser.ProtoUDP:
+		if f.framing == FramingTCP || !looksLikeRTP(pkt.Payload) {
+			return false
+		}
+	default:
+		return false
+	}
+	f.seen[pkt.Flow] = true
+	if len(f.seen)-1 != f.index {
+		return false
+	}
+	log.Println("pcap stream:", pkt.Flow)
+	flow := pkt.Flow
+	f.flow = &flow
+	f.related = map[pcapparser.Flow]*tcpSplitter{}
+	if flow.Proto == pcapparser.ProtoTCP {
+		// rtcp-mux, 反方向的连接上可能有接收端的rtcp
+		f.related[flow] = newTCPSplitter(flow)
+		f.related[flow.Reverse()] = newTCPSplitter(flow.Reverse())
+		return true
+	}
+	// RFC 3550 11, rtcp用rtp端口+1, 没有复用时在另外的流上
+	rtcpFlow := flow
+	rtcpFlow.SrcPort++
+	rtcpFlow.DstPort++
+	for _, related := range []pcapparser.Flow{flow, flow.Reverse(), rtcpFlow, rtcpFlow.Reverse()} {
+		f.related[related] = nil
+	}
+	return true
+}
+
+func (f *pcapFramer) ReadFrame() (*Frame, error) {
+	for len(f.frames) == 0 {
+		if f.eof {
+			return nil, io.EOF
+		}
+		if err := f.readPacket(); err != nil {
+			return nil, err
+		}
+	}
+	frame := f.frames[0]
+	f.frames = f.frames[1:]
+	return frame, nil
+}
+
+func (f *pcapFramer) readPacket() error {
+	pkt, err := f.reader.ReadPacket()
+	if err == io.EOF {
+		f.eof = true
+		if f.flow == nil {
+			log.Println("not found rtp stream in pcap, index:", f.index)
+			return pcapparser.ErrNoStream
+		}
+		for _, flow := range []pcapparser.Flow{*f.flow, f.flow.Reverse()} {
+			if splitter := f.related[flow]; splitter != nil {
+				f.frames = append(f.frames, splitter.split(splitter.stream.Flush())...)
+			}
+		}
+		return nil
+	}
+	if err != nil {
+		log.Println("read pcap err:", err)
+		return err
+	}
+	if f.flow == nil && !f.selectFlow(pkt) {
+		return nil
+	}
+	splitter, ok := f.related[pkt.Flow]
+	if !ok {
+		return nil
+	}
+	if splitter == nil {
+		// 端口+1的流和反方向的流只要rtcp
+		if pkt.Flow != *f.flow && !isRTCP(pkt.Payload) {
+			return nil
+		}
+		f.frames = append(f.frames, &Frame{
+			Data:      pkt.Payload,
+			Offset:    pkt.Offset,
+			Timestamp: pkt.Timestamp,
+		})
+		return nil
+	}
+	f.frames = append(f.frames, splitter.split(splitter.stream.Add(pkt))...)
+	return nil
+}
+
+// tcpSplitter 一个方向的tcp流的重组和rfc4571切分
+type tcpSplitter struct {
+	stream *pcapparser.TCPStream
+	// tcp重组后还没切分的数据
+	pending []pcapparser.Segment
+	buf     []byte
+	// 空洞之后还没找到下一个rtp包的开始, skipped是已经跳过的字节数
+	resyncing bool
+	skipped   int
+	// 最后一个rtp包的ssrc, 空洞后用来确认找到的是同一条流的包
+	ssrc    uint32
+	hasSSRC bool
+}
+
+func newTCPSplitter(flow pcapparser.Flow) *tcpSplitter {
+	return &tcpSplitter{stream: pcapparser.NewTCPStream(flow)}
+}
+
+// split 把重组好的tcp负载按2个字节的长度切成rtp包, 包的时间和偏移取包头所在的tcp段
+// 遇到空洞时丢掉空洞前没切完的数据, 从空洞后找下一个长度+rtp头重新开始切分
+func (s *tcpSplitter) split(segs []pcapparser.Segment) []*Frame {
+	var frames []*Frame
+	for _, seg := range segs {
+		if seg.Gap {
+			s.dropBeforeGap(seg)
+		}
+		s.pending = append(s.pending, seg)
+		s.buf = append(s.buf, seg.Data...)
+		frames = append(frames, s.splitFrames()...)
+	}
+	return frames
+}
+
+func (s *tcpSplitter) dropBeforeGap(seg pcapparser.Segment) {
+	if len(s.buf) > 0 {
+		log.Printf("%s: drop %d bytes before tcp gap, gap: %d bytes, pos: %d", s.stream.Flow, len(s.buf), seg.GapBytes, seg.Offset)
+	}
+	s.pending = s.pending[:0]
+	s.buf = s.buf[:0]
+	s.resyncing = true
+	s.skipped = 0
+}
+
+func (s *tcpSplitter) splitFrames() []*Frame {
+	if s.resyncing && !s.resync() {
+		return nil
+	}
+	var frames []*Frame
+	consumed := 0
+	for len(s.buf)-consumed >= 2 {
+		rtpLen := int(binary.BigEndian.Uint16(s.buf[consumed:]))
+		if len(s.buf)-consumed < 2+rtpLen {
+			break
+		}
+		seg := s.segmentAt(consumed)
+		data := make([]byte, rtpLen)
+		copy(data, s.buf[consumed+2:])
+		if looksLikeRTP(data) {
+			s.ssrc = binary.BigEndian.Uint32(data[8:])
+			s.hasSSRC = true
+		}
+		frames = append(frames, &Frame{
+			Data:      data,
+			Offset:    seg.Offset,
+			Timestamp: seg.Timestamp,
+		})
+		consumed += 2 + rtpLen
+	}
+	s.consume(consumed)
+	return frames
+}
+
+func (s *tcpSplitter) consume(n int) {
+	s.dropSegments(n)
+	s.buf = append(s.buf[:0], s.buf[n:]...)
+}
+
+// resync 在空洞后面找一个合理的长度, 后面跟着rtp v2的头. 空洞前有rtp包时要求ssrc相同,
+// 否则要求下一个包的长度和头也对得上. 找到时丢掉前面的数据返回true, 数据不够判断时等下一段
+func (s *tcpSplitter) resync() bool {
+	pos := 0
+	found := false
+	for ; pos+2+rtpHeaderLen <= len(s.buf); pos++ {
+		if !pcapparser.LooksLikeRTPOverTCP(s.buf[pos:]) {
+			continue
+		}
+		if s.hasSSRC {
+			if binary.BigEndian.Uint32(s.buf[pos+2+8:]) == s.ssrc {
+				found = true
+				break
+			}
+			continue
+		}
+		next := pos + 2 + int(binary.BigEndian.Uint16(s.buf[pos:]))
+		if next+3 > len(s.buf) {
+			// 下一个包的头还没收到, 先从这里等
+			break
+		}
+		if s.buf[next+2]>>6 == 2 && int(binary.BigEndian.Uint16(s.buf[next:])) >= rtpHeaderLen {
+			found = true
+			break
+		}
+	}
+	s.skipped += pos
+	s.consume(pos)
+	if !found {
+		return false
+	}
+	log.Printf("%s: resync after tcp gap, skip %d bytes, pos: %d", s.stream.Flow, s.skipped, s.segmentAt(0).Offset)
+	s.resyncing = false
+	s.skipped = 0
+	return true
+}
+
+// segmentAt 返回buf中第pos个字节所在的tcp段
+func (s *tcpSplitter) segmentAt(pos int) pcapparser.Segment {
+	for _, seg := range s.pending {
+		if pos < len(seg.Data) {
+			return seg
+		}
+		pos -= len(seg.Data)
+	}
+	return s.pending[len(s.pending)-1]
+}
+
+// 丢掉已经完全切分完的tcp段, 剩下的第一个段截掉已经用掉的部分
+func (s *tcpSplitter) dropSegments(consumed int) {
+	for len(s.pending) > 0 && consumed >= len(s.pending[0].Data) {
+		consumed -= len(s.pending[0].Data)
+		s.pending = s.pending[1:]
+	}
+	if len(s.pending) > 0 && consumed > 0 {
+		s.pending[0].Data = s.pending[0].Data[consumed:]
+	}
+}
+
+// looksLikeRTP 判断一个udp报文是否是rtp包, 版本号为2, 长度够一个rtp头,
+// 排除掉rtcp的包类型
+func looksLikeRTP(data []byte) bool {
+	if len(data) < 12 || data[0]>>6 != 2 {
+		return false
+	}
+	pt := data[1] & 0x7f
+	return pt < 72 || pt > 76
+}
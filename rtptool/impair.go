@@ -0,0 +1,319 @@
+package rtptool
+
+import (
+	"container/heap"
+	"errors"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrCheckImpair = errors.New("check impair param error")
+
+// impairer 发送时模拟网络损伤: 丢包(随机或者Gilbert-Elliott突发), 重复, 乱序, 比特错误.
+// 延时和抖动由delayLine处理
+type impairer struct {
+	lossRate    float64
+	ge          *gilbertElliott
+	dupRate     float64
+	reorderRate float64
+	// 乱序的包推迟到后面第几个包之后发
+	reorderDepth int
+	corruptRate  float64
+	rand         *rand.Rand
+	held         []heldPkt
+	// 统计
+	lost       int
+	duplicated int
+	reordered  int
+	corrupted  int
+}
+
+type heldPkt struct {
+	data []byte
+	// 还要再发几个包才轮到它
+	remain int
+}
+
+// gilbertElliott 两状态的突发丢包模型, 百分比
+type gilbertElliott struct {
+	// good到bad, bad到good的转移概率
+	p float64
+	r float64
+	// 两个状态下的丢包率
+	lossGood float64
+	lossBad  float64
+	bad      bool
+}
+
+// parseGilbertElliott 解析 "p,r[,lossGood,lossBad]", 都是百分比, 默认lossGood为0, lossBad为100
+func parseGilbertElliott(s string) (*gilbertElliott, error) {
+	if s == "" {
+		return nil, nil
+	}
+	items := strings.Split(s, ",")
+	if len(items) != 2 && len(items) != 4 {
+		log.Println("check ge loss error:", s)
+		return nil, ErrCheckImpair
+	}
+	values := []float64{0, 0, 0, 100}
+	for i, item := range items {
+		v, err := strconv.ParseFloat(strings.TrimSpace(item), 64)
+		if err != nil || v < 0 || v > 100 {
+			log.Println("check ge loss error:", s)
+			return nil, ErrCheckImpair
+		}
+		values[i] = v
+	}
+	return &gilbertElliott{
+		p:        values[0],
+		r:        values[1],
+		lossGood: values[2],
+		lossBad:  values[3],
+	}, nil
+}
+
+// newImpairer 没有配置任何损伤时返回nil
+func newImpairer(param *ConsoleParam) (*impairer, error) {
+	ge, err := parseGilbertElliott(param.GELoss)
+	if err != nil {
+		return nil, err
+	}
+	for _, rate := range []float64{param.LossRate, param.DupRate, param.ReorderRate, param.CorruptRate} {
+		if rate < 0 || rate > 100 {
+			log.Println("check impair rate error:", rate)
+			return nil, ErrCheckImpair
+		}
+	}
+	if param.LossRate == 0 && ge == nil && param.DupRate == 0 && param.ReorderRate == 0 && param.CorruptRate == 0 {
+		return nil, nil
+	}
+	if param.ReorderDepth <= 0 {
+		log.Println("check reorder depth error:", param.ReorderDepth)
+		return nil, ErrCheckImpair
+	}
+	seed := param.ImpairSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	log.Println("impair seed:", seed)
+	return &impairer{
+		lossRate:     param.LossRate,
+		ge:           ge,
+		dupRate:      param.DupRate,
+		reorderRate:  param.ReorderRate,
+		reorderDepth: param.ReorderDepth,
+		corruptRate:  param.CorruptRate,
+		rand:         rand.New(rand.NewSource(seed)),
+	}, nil
+}
+
+func (im *impairer) hit(rate float64) bool {
+	return rate > 0 && im.rand.Float64()*100 < rate
+}
+
+func (im *impairer) drop() bool {
+	if im.ge != nil {
+		if im.ge.bad {
+			im.ge.bad = !im.hit(im.ge.r)
+		} else {
+			im.ge.bad = im.hit(im.ge.p)
+		}
+		lossRate := im.ge.lossGood
+		if im.ge.bad {
+			lossRate = im.ge.lossBad
+		}
+		if im.hit(lossRate) {
+			return true
+		}
+	}
+	return im.hit(im.lossRate)
+}
+
+// process 对一个包做损伤, 返回现在要发出去的包, 可能为空, 也可能包括之前推迟的包.
+// hdrLen之前的rtp头不做比特错误, 接收端还能认出是哪个包
+func (im *impairer) process(pkt []byte, hdrLen int) [][]byte {
+	if im.drop() {
+		im.lost++
+		return nil
+	}
+	if hdrLen < len(pkt) && im.hit(im.corruptRate) {
+		bit := im.rand.Intn((len(pkt) - hdrLen) * 8)
+		pkt[hdrLen+bit/8] ^= 1 << uint(bit%8)
+		im.corrupted++
+	}
+	count := 1
+	if im.hit(im.dupRate) {
+		im.duplicated++
+		count = 2
+	}
+	var out [][]byte
+	for i := 0; i < count; i++ {
+		if i == 0 && im.hit(im.reorderRate) {
+			im.reordered++
+			im.held = append(im.held, heldPkt{data: pkt, remain: im.reorderDepth})
+			continue
+		}
+		out = im.emit(out, pkt)
+	}
+	return out
+}
+
+// emit 发出一个包, 推迟的包等够了个数之后跟在后面发
+func (im *impairer) emit(out [][]byte, pkt []byte) [][]byte {
+	out = append(out, pkt)
+	held := im.held[:0]
+	var ready [][]byte
+	for _, h := range im.held {
+		h.remain--
+		if h.remain <= 0 {
+			ready = append(ready, h.data)
+			continue
+		}
+		held = append(held, h)
+	}
+	im.held = held
+	return append(out, ready...)
+}
+
+// flush 输入结束, 把推迟的包都发出去
+func (im *impairer) flush() [][]byte {
+	var out [][]byte
+	for _, h := range im.held {
+		out = append(out, h.data)
+	}
+	im.held = nil
+	return out
+}
+
+func (im *impairer) dump() {
+	log.Println("impair lost:", im.lost, "duplicated:", im.duplicated, "reordered:", im.reordered, "corrupted:", im.corrupted)
+}
+
+// delayLine 每个包延时-delay再加上[-jitter, jitter]的随机抖动之后发送,
+// 抖动比包间隔大时包会自然乱序
+type delayLine struct {
+	delay  time.Duration
+	jitter time.Duration
+	rand   *rand.Rand
+	in     chan delayedPkt
+	done   chan struct{}
+	send   func([]byte) error
+	mu     sync.Mutex
+	err    error
+}
+
+type delayedPkt struct {
+	data []byte
+	due  time.Time
+	// 相同发送时间时按进来的顺序
+	index int
+}
+
+type delayQueue []delayedPkt
+
+func (q delayQueue) Len() int { return len(q) }
+func (q delayQueue) Less(i, j int) bool {
+	if q[i].due.Equal(q[j].due) {
+		return q[i].index < q[j].index
+	}
+	return q[i].due.Before(q[j].due)
+}
+func (q delayQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *delayQueue) Push(x interface{}) { *q = append(*q, x.(delayedPkt)) }
+func (q *delayQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// newDelayLine 没有配置延时和抖动时返回nil
+func newDelayLine(param *ConsoleParam, send func([]byte) error) (*delayLine, error) {
+	if param.Delay < 0 || param.Jitter < 0 {
+		log.Println("check delay error, delay:", param.Delay, "jitter:", param.Jitter)
+		return nil, ErrCheckImpair
+	}
+	if param.Delay == 0 && param.Jitter == 0 {
+		return nil, nil
+	}
+	seed := param.ImpairSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	d := &delayLine{
+		delay:  param.Delay,
+		jitter: param.Jitter,
+		rand:   rand.New(rand.NewSource(seed + 1)),
+		in:     make(chan delayedPkt, 1024),
+		done:   make(chan struct{}),
+		send:   send,
+	}
+	go d.run()
+	return d, nil
+}
+
+func (d *delayLine) push(pkt []byte, index int) error {
+	due := time.Now().Add(d.delay)
+	if d.jitter > 0 {
+		due = due.Add(time.Duration(d.rand.Int63n(int64(2*d.jitter)+1)) - d.jitter)
+	}
+	d.in <- delayedPkt{data: pkt, due: due, index: index}
+	return d.getErr()
+}
+
+func (d *delayLine) run() {
+	defer close(d.done)
+	queue := &delayQueue{}
+	timer := time.NewTimer(time.Hour)
+	in := d.in
+	for in != nil || queue.Len() > 0 {
+		if queue.Len() > 0 {
+			timer.Reset(time.Until((*queue)[0].due))
+		}
+		select {
+		case pkt, ok := <-in:
+			if !ok {
+				in = nil
+				break
+			}
+			heap.Push(queue, pkt)
+		case <-timer.C:
+			now := time.Now()
+			for queue.Len() > 0 && !(*queue)[0].due.After(now) {
+				pkt := heap.Pop(queue).(delayedPkt)
+				if err := d.send(pkt.data); err != nil {
+					d.setErr(err)
+				}
+			}
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+	}
+}
+
+func (d *delayLine) setErr(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.err = err
+}
+
+func (d *delayLine) getErr() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.err
+}
+
+// close 等延时的包都发完
+func (d *delayLine) close() error {
+	close(d.in)
+	<-d.done
+	return d.getErr()
+}
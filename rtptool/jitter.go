@@ -0,0 +1,172 @@
+package rtptool
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// RFC 3551 静态payload type的时钟频率, 动态的用-clock-rate
+var staticClockRates = map[uint32]uint32{
+	0: 8000, 3: 8000, 4: 8000, 5: 8000, 6: 16000, 7: 8000, 8: 8000, 9: 8000,
+	10: 44100, 11: 44100, 12: 8000, 13: 8000, 14: 90000, 15: 8000, 16: 11025,
+	17: 22050, 18: 8000, 25: 90000, 26: 90000, 28: 90000, 31: 90000, 32: 90000,
+	33: 90000, 34: 90000,
+}
+
+// 动态payload type没有配置-clock-rate时用视频的时钟频率
+const defaultClockRate = 90000
+
+// 帧间隔直方图的区间上限, 单位ms, 最后一个区间是大于最后一个值
+var frameIntervalBuckets = []int{10, 20, 30, 40, 50, 80, 100, 200, 500, 1000}
+
+func clockRateOf(pt uint32, defaultRate int) uint32 {
+	if rate, ok := staticClockRates[pt]; ok {
+		return rate
+	}
+	if defaultRate <= 0 {
+		return defaultClockRate
+	}
+	return uint32(defaultRate)
+}
+
+// streamTiming 根据抓包的到达时间计算抖动和时钟漂移
+type streamTiming struct {
+	clockRate uint32
+	hasTime   bool
+	// RFC 3550 6.4.1, 单位是rtp时钟
+	jitter       float64
+	maxJitter    float64
+	lastTransit  float64
+	firstArrival time.Time
+	lastArrival  time.Time
+	// 扩展后的rtp时间戳, 处理32位回绕
+	firstTs   int64
+	lastTs    int64
+	lastRawTs uint32
+	// rtp时间 - 到达时间, 相对第一个包, 单位秒
+	minOffset float64
+	maxOffset float64
+	// 按时间戳划分的帧
+	frameCount      uint32
+	lastFrameTs     uint32
+	lastFrameArrive time.Time
+	frameIntervals  []uint32
+	minInterval     time.Duration
+	maxInterval     time.Duration
+	sumInterval     time.Duration
+}
+
+func newStreamTiming(clockRate uint32) streamTiming {
+	return streamTiming{
+		clockRate:      clockRate,
+		frameIntervals: make([]uint32, len(frameIntervalBuckets)+1),
+	}
+}
+
+// update 按到达顺序统计一个包, 输入没有到达时间时什么都不做
+func (t *streamTiming) update(rtp *RTP, arrival time.Time) {
+	if arrival.IsZero() {
+		return
+	}
+	if !t.hasTime {
+		t.hasTime = true
+		t.firstArrival = arrival
+		t.firstTs = int64(rtp.timestamp)
+		t.lastTs = t.firstTs
+		t.lastRawTs = rtp.timestamp
+		t.lastTransit = t.transit(arrival, t.lastTs)
+		t.frameCount = 1
+		t.lastFrameTs = rtp.timestamp
+		t.lastFrameArrive = arrival
+		t.lastArrival = arrival
+		return
+	}
+	t.lastTs += int64(int32(rtp.timestamp - t.lastRawTs))
+	t.lastRawTs = rtp.timestamp
+	t.lastArrival = arrival
+
+	// J(i) = J(i-1) + (|D(i-1,i)| - J(i-1))/16
+	transit := t.transit(arrival, t.lastTs)
+	d := math.Abs(transit - t.lastTransit)
+	t.lastTransit = transit
+	t.jitter += (d - t.jitter) / 16
+	if t.jitter > t.maxJitter {
+		t.maxJitter = t.jitter
+	}
+
+	offset := -transit / float64(t.clockRate)
+	if offset < t.minOffset {
+		t.minOffset = offset
+	}
+	if offset > t.maxOffset {
+		t.maxOffset = offset
+	}
+
+	// 时间戳变了是新的一帧
+	if rtp.timestamp != t.lastFrameTs {
+		interval := arrival.Sub(t.lastFrameArrive)
+		t.addFrameInterval(interval)
+		t.frameCount++
+		t.lastFrameTs = rtp.timestamp
+		t.lastFrameArrive = arrival
+	}
+}
+
+// transit 到达时间换算成rtp时钟后减去rtp时间戳, 都相对于第一个包
+func (t *streamTiming) transit(arrival time.Time, ts int64) float64 {
+	return arrival.Sub(t.firstArrival).Seconds()*float64(t.clockRate) - float64(ts-t.firstTs)
+}
+
+func (t *streamTiming) addFrameInterval(interval time.Duration) {
+	if t.frameCount == 1 || interval < t.minInterval {
+		t.minInterval = interval
+	}
+	if interval > t.maxInterval {
+		t.maxInterval = interval
+	}
+	t.sumInterval += interval
+	ms := int(interval / time.Millisecond)
+	idx := len(frameIntervalBuckets)
+	for i, upper := range frameIntervalBuckets {
+		if ms < upper {
+			idx = i
+			break
+		}
+	}
+	t.frameIntervals[idx]++
+}
+
+func (t *streamTiming) dump() {
+	if !t.hasTime {
+		log.Println("\tno arrival time in input, skip jitter analysis")
+		return
+	}
+	wall := t.lastArrival.Sub(t.firstArrival).Seconds()
+	media := float64(t.lastTs-t.firstTs) / float64(t.clockRate)
+	log.Println("\tclock rate:", t.clockRate)
+	log.Printf("\tjitter: %.3fms max: %.3fms", t.jitter*1000/float64(t.clockRate), t.maxJitter*1000/float64(t.clockRate))
+	log.Printf("\twall clock duration: %.3fs rtp clock duration: %.3fs", wall, media)
+	if wall > 0 {
+		log.Printf("\tclock drift: %.3fms (%.1fppm)", (media-wall)*1000, (media-wall)/wall*1e6)
+	}
+	log.Printf("\trtp - wall clock offset: min %.3fms max %.3fms", t.minOffset*1000, t.maxOffset*1000)
+	log.Println("\tframe count:", t.frameCount)
+	if t.frameCount < 2 {
+		return
+	}
+	avg := t.sumInterval / time.Duration(t.frameCount-1)
+	log.Printf("\tframe interval: min %v max %v avg %v", t.minInterval, t.maxInterval, avg)
+	lower := 0
+	for i, count := range t.frameIntervals {
+		bucket := fmt.Sprintf(">=%dms", lower)
+		if i < len(frameIntervalBuckets) {
+			bucket = fmt.Sprintf("%d-%dms", lower, frameIntervalBuckets[i])
+			lower = frameIntervalBuckets[i]
+		}
+		if count > 0 {
+			log.Printf("\t\t%-10s %d", bucket, count)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package rtptool
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// udp报文的最大长度
+const maxDatagramSize = 65536
+
+// 实时接收时多久没有收到数据就返回一次ErrFrameIdle
+const liveIdleInterval = time.Second
+
+// ErrFrameIdle 一段时间内没有收到数据, 不是错误, 可以继续ReadFrame
+var ErrFrameIdle = errors.New("no frame received")
+
+// LiveFramer 从网络实时接收rtp的Framer, Close之后ReadFrame返回io.EOF
+type LiveFramer interface {
+	Framer
+	Close() error
+}
+
+// udpFramer 监听udp端口, 一个报文一个rtp包, 到达时间取收到的时间
+type udpFramer struct {
+	conn net.PacketConn
+	// 每次都读到这个缓冲区, 再按实际长度复制出来, 缓存的包不会各占64K
+	buf    []byte
+	pos    int64
+	record *rtpdumpWriter
+	mu     sync.Mutex
+	closed bool
+}
+
+// ListenUDP 在addr上接收rtp, record不为nil时按rtpdump格式录下收到的报文
+func ListenUDP(addr string, record io.Writer) (LiveFramer, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	log.Println("listen udp:", conn.LocalAddr())
+	f := &udpFramer{conn: conn, buf: make([]byte, maxDatagramSize)}
+	if record != nil {
+		f.record = &rtpdumpWriter{w: record}
+	}
+	return newIdleFramer(f), nil
+}
+
+func (f *udpFramer) Framing() string {
+	return FramingUDP
+}
+
+func (f *udpFramer) ReadFrame() (*Frame, error) {
+	n, addr, err := f.conn.ReadFrom(f.buf)
+	if err != nil {
+		if f.isClosed() {
+			return nil, io.EOF
+		}
+		log.Println(err)
+		return nil, err
+	}
+	frame := &Frame{
+		Data:      append([]byte(nil), f.buf[:n]...),
+		Offset:    f.pos,
+		Timestamp: time.Now(),
+	}
+	f.pos += int64(n)
+	if f.record != nil {
+		if err := f.record.write(frame, addr); err != nil {
+			return nil, err
+		}
+	}
+	return frame, nil
+}
+
+func (f *udpFramer) isClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+func (f *udpFramer) Close() error {
+	f.mu.Lock()
+	f.closed = true
+	f.mu.Unlock()
+	return f.conn.Close()
+}
+
+// tcpLiveFramer GB28181的tcp被动模式等待对端连上来, 主动模式连接对端,
+// 连接上的数据按rfc4571切分
+type tcpLiveFramer struct {
+	listener net.Listener
+	record   io.Writer
+	mu       sync.Mutex
+	conn     net.Conn
+	framer   *tcpFramer
+	closed   bool
+}
+
+// ListenTCP tcp被动模式, 在addr上等待一个连接, record不为nil时录下原始的tcp负载
+func ListenTCP(addr string, record io.Writer) (LiveFramer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	log.Println("listen tcp:", listener.Addr())
+	return newIdleFramer(&tcpLiveFramer{
+		listener: listener,
+		record:   record,
+	}), nil
+}
+
+// DialTCP tcp主动模式, 连接到发送端
+func DialTCP(addr string, record io.Writer) (LiveFramer, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	log.Println("connected to:", conn.RemoteAddr())
+	f := &tcpLiveFramer{record: record}
+	f.setConn(conn)
+	return newIdleFramer(f), nil
+}
+
+func (f *tcpLiveFramer) setConn(conn net.Conn) {
+	var r io.Reader = conn
+	if f.record != nil {
+		r = io.TeeReader(conn, f.record)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.conn = conn
+	f.framer = &tcpFramer{
+		r:    bufio.NewReader(r),
+		live: true,
+	}
+	// 等连接的时候已经Close了
+	if f.closed {
+		conn.Close()
+	}
+}
+
+func (f *tcpLiveFramer) Framing() string {
+	return FramingTCP
+}
+
+func (f *tcpLiveFramer) ReadFrame() (*Frame, error) {
+	if f.framer == nil {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			if f.isClosed() {
+				return nil, io.EOF
+			}
+			log.Println(err)
+			return nil, err
+		}
+		log.Println("accept connection from:", conn.RemoteAddr())
+		// GB28181一个连接对应一路流, 不再接受新的连接
+		f.listener.Close()
+		f.setConn(conn)
+	}
+	frame, err := f.framer.ReadFrame()
+	if err != nil && f.isClosed() {
+		return nil, io.EOF
+	}
+	return frame, err
+}
+
+func (f *tcpLiveFramer) isClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+func (f *tcpLiveFramer) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	if f.listener != nil {
+		f.listener.Close()
+	}
+	if f.conn != nil {
+		return f.conn.Close()
+	}
+	return nil
+}
+
+// idleFramer 在单独的goroutine里读, 一直没有数据时返回ErrFrameIdle,
+// 没有流量的时候实时统计也能按时打印. 不用读超时是因为tcp读到一半超时会切错包
+type idleFramer struct {
+	LiveFramer
+	frames chan frameResult
+	done   chan struct{}
+	once   sync.Once
+}
+
+type frameResult struct {
+	frame *Frame
+	err   error
+}
+
+func newIdleFramer(f LiveFramer) *idleFramer {
+	idle := &idleFramer{
+		LiveFramer: f,
+		frames:     make(chan frameResult),
+		done:       make(chan struct{}),
+	}
+	go idle.readLoop()
+	return idle
+}
+
+func (f *idleFramer) readLoop() {
+	defer close(f.frames)
+	for {
+		frame, err := f.LiveFramer.ReadFrame()
+		select {
+		case f.frames <- frameResult{frame, err}:
+		case <-f.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (f *idleFramer) ReadFrame() (*Frame, error) {
+	timer := time.NewTimer(liveIdleInterval)
+	defer timer.Stop()
+	select {
+	case res, ok := <-f.frames:
+		if !ok {
+			return nil, io.EOF
+		}
+		return res.frame, res.err
+	case <-timer.C:
+		return nil, ErrFrameIdle
+	}
+}
+
+func (f *idleFramer) Close() error {
+	f.once.Do(func() { close(f.done) })
+	return f.LiveFramer.Close()
+}
+
+// rtpdumpWriter 按rtptools的rtpdump格式录制udp报文, 可以再作为-file的输入
+type rtpdumpWriter struct {
+	w     io.Writer
+	start time.Time
+}
+
+func (w *rtpdumpWriter) write(frame *Frame, addr net.Addr) error {
+	if w.start.IsZero() {
+		if err := w.writeHeader(frame.Timestamp, addr); err != nil {
+			return err
+		}
+	}
+	// plen为0表示rtcp
+	plen := len(frame.Data)
+	if isRTCP(frame.Data) {
+		plen = 0
+	}
+	hdr := make([]byte, 8)
+	binary.BigEndian.PutUint16(hdr[0:], uint16(len(frame.Data)+8))
+	binary.BigEndian.PutUint16(hdr[2:], uint16(plen))
+	binary.BigEndian.PutUint32(hdr[4:], uint32(frame.Timestamp.Sub(w.start)/time.Millisecond))
+	if _, err := w.w.Write(append(hdr, frame.Data...)); err != nil {
+		log.Println(err)
+		return err
+	}
+	return nil
+}
+
+func (w *rtpdumpWriter) writeHeader(start time.Time, addr net.Addr) error {
+	w.start = start
+	ip := net.IPv4zero
+	port := 0
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		if ip4 := udpAddr.IP.To4(); ip4 != nil {
+			ip = ip4
+		}
+		port = udpAddr.Port
+	}
+	line := fmt.Sprintf("%s%s/%d\n", rtpdumpMagic, ip, port)
+	hdr := make([]byte, 16)
+	binary.BigEndian.PutUint32(hdr[0:], uint32(start.Unix()))
+	binary.BigEndian.PutUint32(hdr[4:], uint32(start.Nanosecond()/1000))
+	copy(hdr[8:], ip.To4())
+	binary.BigEndian.PutUint16(hdr[12:], uint16(port))
+	if _, err := w.w.Write(append([]byte(line), hdr...)); err != nil {
+		log.Println(err)
+		return err
+	}
+	return nil
+}
+
+// rollingStats 实时接收时每隔一段时间打印一次各个流在这段时间内的统计
+func (decoder *RTPDecoder) rollingStats() {
+	interval := decoder.param.StatsInterval
+	if interval <= 0 {
+		return
+	}
+	now := time.Now()
+	if decoder.lastRolling.IsZero() {
+		decoder.lastRolling = now
+		return
+	}
+	elapsed := now.Sub(decoder.lastRolling)
+	if elapsed < interval {
+		return
+	}
+	decoder.lastRolling = now
+	if len(decoder.streamList) == 0 {
+		log.Printf("no rtp received in last %v", elapsed.Round(time.Millisecond))
+	}
+	for _, stream := range decoder.streamList {
+		stream.rollingStats(elapsed)
+	}
+}
+
+func (stream *RTPStream) rollingStats(elapsed time.Duration) {
+	lost := stream.stats.lost(stream.seq.expected())
+	pkts := stream.pktCount - stream.rollingPkts
+	lostDelta := lost - stream.rollingLost
+	lossRate := 0.0
+	if int64(pkts)+lostDelta > 0 {
+		lossRate = float64(lostDelta) * 100 / float64(int64(pkts)+lostDelta)
+	}
+	bitrate := float64(stream.byteCount-stream.rollingBytes) * 8 / elapsed.Seconds() / 1000
+	jitter := stream.timing.jitter * 1000 / float64(stream.timing.clockRate)
+	log.Printf("ssrc: %d pkts: %d(+%d) lost: %d(+%d) loss: %.2f%% jitter: %.3fms bitrate: %.1fkbps",
+		stream.SSRC, stream.pktCount, pkts, lost, lostDelta, lossRate, jitter, bitrate)
+	stream.rollingPkts = stream.pktCount
+	stream.rollingLost = lost
+	stream.rollingBytes = stream.byteCount
+}
@@ -0,0 +1,237 @@
+package rtptool
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+)
+
+const (
+	// 从第一个完整的关键帧开始输出
+	PsStartKeyFrame = "keyframe"
+	// 从第一个包开始全部输出
+	PsStartAll = "all"
+)
+
+// psm里的视频编码类型
+const (
+	streamTypeH264 = 0x1b
+	streamTypeH265 = 0x24
+)
+
+var ErrCheckPsStart = errors.New("check ps start mode error")
+
+// psAssembler 把一个流按序列号排好的rtp负载按帧拼成ps.
+// marker位表示一帧结束, 没有marker位时时间戳变化也表示上一帧结束
+type psAssembler struct {
+	mode    string
+	started bool
+	// 正在拼的帧
+	open       bool
+	frame      []byte
+	frameTs    uint32
+	incomplete bool
+	lastSeq    uint32
+	hasLast    bool
+	// 从psm得到的视频编码类型, 0表示还不知道
+	streamType uint8
+	// 统计
+	frames           int
+	keyFrames        int
+	incompleteFrames int
+	noMarkerFrames   int
+	latePkts         int
+	skippedFrames    int
+	skippedBytes     int64
+}
+
+func checkPsStart(mode string) error {
+	if mode != PsStartKeyFrame && mode != PsStartAll {
+		log.Println("unknown ps start mode:", mode)
+		return ErrCheckPsStart
+	}
+	return nil
+}
+
+// push 加入一个包, 返回拼好的帧, 可能没有, 时间戳变化同时又带marker位时有两个
+func (a *psAssembler) push(rtp *RTP) [][]byte {
+	gap := false
+	if a.hasLast {
+		if rtp.extSeq <= a.lastSeq && a.lastSeq-rtp.extSeq <= maxMisorder {
+			// 重复的或者来晚了的包, 所在的帧已经输出了
+			a.latePkts++
+			return nil
+		}
+		gap = rtp.extSeq != a.lastSeq+1
+	}
+	a.lastSeq = rtp.extSeq
+	a.hasLast = true
+	var out [][]byte
+	if a.open && rtp.timestamp != a.frameTs {
+		a.noMarkerFrames++
+		out = a.endFrame(out)
+	}
+	if !a.open {
+		a.open = true
+		a.frame = nil
+		a.frameTs = rtp.timestamp
+		a.incomplete = false
+	}
+	// 丢了包, 一帧结束之后丢的包算作下一帧开头丢了
+	if gap {
+		a.incomplete = true
+	}
+	a.frame = append(a.frame, rtp.payload...)
+	if rtp.M == 1 {
+		out = a.endFrame(out)
+	}
+	return out
+}
+
+// resetSeq 对端序列号重新开始, 下一个包不和之前的序列号比较
+func (a *psAssembler) resetSeq() {
+	a.hasLast = false
+	a.lastSeq = 0
+}
+
+// flush 输入结束, 返回最后一个没有marker位的帧
+func (a *psAssembler) flush() [][]byte {
+	if !a.open {
+		return nil
+	}
+	a.noMarkerFrames++
+	return a.endFrame(nil)
+}
+
+func (a *psAssembler) endFrame(out [][]byte) [][]byte {
+	frame := a.frame
+	a.frame = nil
+	a.open = false
+	a.frames++
+	key := a.isKeyFrame(frame)
+	if key {
+		a.keyFrames++
+	}
+	if a.incomplete {
+		a.incompleteFrames++
+	}
+	if a.started {
+		return append(out, frame)
+	}
+	if a.mode == PsStartKeyFrame {
+		pos := packHeaderPos(frame)
+		if !key || a.incomplete || pos < 0 {
+			a.skippedFrames++
+			a.skippedBytes += int64(len(frame))
+			return out
+		}
+		a.skippedBytes += int64(pos)
+		frame = frame[pos:]
+	}
+	log.Println("start ps output, skipped frames:", a.skippedFrames, "bytes:", a.skippedBytes)
+	a.started = true
+	return append(out, frame)
+}
+
+// isKeyFrame 帧里有IDR/SPS(h264)或者IRAP/VPS/SPS(h265)时是关键帧.
+// 认不出视频编码时, 按有没有system header判断, 大部分设备只在关键帧前发system header
+func (a *psAssembler) isKeyFrame(data []byte) bool {
+	sysHeader := false
+	sawNAL := false
+	for i := 0; i+3 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		code := data[i+3]
+		switch {
+		case code == 0xbb:
+			sysHeader = true
+		case code == 0xbc:
+			if streamType := psmVideoType(data[i:]); streamType != 0 {
+				a.streamType = streamType
+			}
+		case code < 0x80:
+			// forbidden_zero_bit为0, 是es里的nal, 不是ps的start code
+			key, ok := isKeyNAL(a.streamType, data[i+3:])
+			if key {
+				return true
+			}
+			sawNAL = sawNAL || ok
+		}
+	}
+	if sawNAL {
+		return false
+	}
+	return sysHeader
+}
+
+// isKeyNAL 第二个返回值表示认出了nal的类型
+func isKeyNAL(streamType uint8, nal []byte) (bool, bool) {
+	switch streamType {
+	case streamTypeH264:
+		nalType := nal[0] & 0x1f
+		return nalType == 5 || nalType == 7, nalType >= 1 && nalType <= 23
+	case streamTypeH265:
+		nalType := (nal[0] >> 1) & 0x3f
+		return (nalType >= 16 && nalType <= 21) || nalType == 32 || nalType == 33, nalType <= 40
+	}
+	// 不知道编码类型, 两种都试一下, 条件严格一些避免误判
+	if nal[0]&0x60 != 0 && (nal[0]&0x1f == 5 || nal[0]&0x1f == 7) {
+		return true, true
+	}
+	if len(nal) >= 2 && nal[1] == 1 {
+		nalType := (nal[0] >> 1) & 0x3f
+		if (nalType >= 16 && nalType <= 21) || nalType == 32 || nalType == 33 {
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// psmVideoType 从psm的基本流映射里找出视频流的编码类型, data从psm的start code开始
+func psmVideoType(data []byte) uint8 {
+	if len(data) < 12 {
+		return 0
+	}
+	infoLen := int(binary.BigEndian.Uint16(data[8:]))
+	pos := 10 + infoLen
+	if pos+2 > len(data) {
+		return 0
+	}
+	mapLen := int(binary.BigEndian.Uint16(data[pos:]))
+	pos += 2
+	end := pos + mapLen
+	if end > len(data) {
+		end = len(data)
+	}
+	for pos+4 <= end {
+		streamType := data[pos]
+		streamID := data[pos+1]
+		esInfoLen := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if streamID >= 0xe0 && streamID <= 0xef {
+			return streamType
+		}
+		pos += 4 + esInfoLen
+	}
+	return 0
+}
+
+// packHeaderPos 第一个pack header的位置, 没有时返回-1
+func packHeaderPos(data []byte) int {
+	for i := 0; i+3 < len(data); i++ {
+		if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 && data[i+3] == 0xba {
+			return i
+		}
+	}
+	return -1
+}
+
+func (a *psAssembler) dump() {
+	if a.frames == 0 {
+		return
+	}
+	log.Println("\tps frames:", a.frames, "key frames:", a.keyFrames, "incomplete:", a.incompleteFrames,
+		"without marker:", a.noMarkerFrames)
+	log.Println("\tps start mode:", a.mode, "skipped frames:", a.skippedFrames, "bytes:", a.skippedBytes,
+		"late pkts dropped:", a.latePkts)
+}
@@ -0,0 +1,515 @@
+package rtptool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// RFC 3550 12.1, RFC 4585 6.1
+const (
+	RTCPTypeSR    = 200
+	RTCPTypeRR    = 201
+	RTCPTypeSDES  = 202
+	RTCPTypeBYE   = 203
+	RTCPTypeAPP   = 204
+	RTCPTypeRTPFB = 205
+	RTCPTypePSFB  = 206
+)
+
+const (
+	// RTPFB的fmt
+	rtcpFmtNACK = 1
+	// PSFB的fmt
+	rtcpFmtPLI = 1
+	rtcpFmtFIR = 4
+	// SDES的item类型
+	sdesEnd   = 0
+	sdesCNAME = 1
+	// NTP时间从1900年开始, 到unix时间的秒数
+	ntpUnixOffset = 2208988800
+)
+
+var ErrCheckRTCP = errors.New("check rtcp error")
+
+// isRTCP RFC 5761 4, rtp和rtcp复用时按第二个字节区分, 192-223是rtcp
+func isRTCP(data []byte) bool {
+	return len(data) >= 8 && data[0]>>6 == 2 && data[1] >= 192 && data[1] <= 223
+}
+
+// RTCPReportBlock SR/RR中的接收报告块
+type RTCPReportBlock struct {
+	// 被报告的流的ssrc
+	SSRC         uint32
+	FractionLost uint8
+	// 24位有符号数, 重复的包多时可能为负
+	CumulativeLost int32
+	HighestSeq     uint32
+	// 单位是rtp时钟
+	Jitter uint32
+	// 最近收到的SR的NTP时间的中间32位, 以及收到后到发送这个报告的延时, 单位1/65536秒
+	LSR  uint32
+	DLSR uint32
+}
+
+// RTCPPacket 复合包中的一个rtcp包
+type RTCPPacket struct {
+	PT uint8
+	// RC/SC/FMT
+	Count uint8
+	// 发送者的ssrc, SDES和BYE没有
+	SSRC uint32
+	// SR的发送者信息
+	NTPTime     uint64
+	RTPTime     uint32
+	PacketCount uint32
+	OctetCount  uint32
+	Reports     []RTCPReportBlock
+	// SDES的cname, ssrc -> cname
+	CNames map[uint32]string
+	// BYE
+	ByeSSRCs []uint32
+	Reason   string
+	// APP的名字, 4个ascii字符
+	Name string
+	// 反馈报文的媒体源ssrc
+	MediaSSRC uint32
+	// NACK请求重传的序列号
+	NackSeqs []uint16
+	// FIR请求关键帧的ssrc
+	FirSSRCs []uint32
+}
+
+// parseRTCP 解析一个复合rtcp包
+func parseRTCP(data []byte) ([]*RTCPPacket, error) {
+	var pkts []*RTCPPacket
+	for len(data) >= 4 {
+		if data[0]>>6 != 2 {
+			return pkts, ErrCheckRTCP
+		}
+		// length是32位字的个数减1
+		pktLen := (int(binary.BigEndian.Uint16(data[2:])) + 1) * 4
+		if pktLen > len(data) {
+			return pkts, ErrCheckRTCP
+		}
+		body := data[4:pktLen]
+		if data[0]&0x20 != 0 && len(body) > 0 {
+			padLen := int(body[len(body)-1])
+			if padLen == 0 || padLen > len(body) {
+				return pkts, ErrCheckRTCP
+			}
+			body = body[:len(body)-padLen]
+		}
+		pkt := &RTCPPacket{
+			PT:    data[1],
+			Count: data[0] & 0x1f,
+		}
+		if err := pkt.parse(body); err != nil {
+			return pkts, err
+		}
+		pkts = append(pkts, pkt)
+		data = data[pktLen:]
+	}
+	return pkts, nil
+}
+
+func (pkt *RTCPPacket) parse(body []byte) error {
+	switch pkt.PT {
+	case RTCPTypeSR:
+		if len(body) < 24 {
+			return ErrCheckRTCP
+		}
+		pkt.SSRC = binary.BigEndian.Uint32(body)
+		pkt.NTPTime = binary.BigEndian.Uint64(body[4:])
+		pkt.RTPTime = binary.BigEndian.Uint32(body[12:])
+		pkt.PacketCount = binary.BigEndian.Uint32(body[16:])
+		pkt.OctetCount = binary.BigEndian.Uint32(body[20:])
+		return pkt.parseReports(body[24:])
+	case RTCPTypeRR:
+		if len(body) < 4 {
+			return ErrCheckRTCP
+		}
+		pkt.SSRC = binary.BigEndian.Uint32(body)
+		return pkt.parseReports(body[4:])
+	case RTCPTypeSDES:
+		return pkt.parseSDES(body)
+	case RTCPTypeBYE:
+		if len(body) < int(pkt.Count)*4 {
+			return ErrCheckRTCP
+		}
+		for i := 0; i < int(pkt.Count); i++ {
+			pkt.ByeSSRCs = append(pkt.ByeSSRCs, binary.BigEndian.Uint32(body[i*4:]))
+		}
+		body = body[pkt.Count*4:]
+		if len(body) > 0 {
+			n := int(body[0])
+			if 1+n > len(body) {
+				return ErrCheckRTCP
+			}
+			pkt.Reason = string(body[1 : 1+n])
+		}
+	case RTCPTypeAPP:
+		if len(body) < 8 {
+			return ErrCheckRTCP
+		}
+		pkt.SSRC = binary.BigEndian.Uint32(body)
+		pkt.Name = string(body[4:8])
+	case RTCPTypeRTPFB, RTCPTypePSFB:
+		if len(body) < 8 {
+			return ErrCheckRTCP
+		}
+		pkt.SSRC = binary.BigEndian.Uint32(body)
+		pkt.MediaSSRC = binary.BigEndian.Uint32(body[4:])
+		pkt.parseFCI(body[8:])
+	}
+	return nil
+}
+
+func (pkt *RTCPPacket) parseReports(data []byte) error {
+	if len(data) < int(pkt.Count)*24 {
+		return ErrCheckRTCP
+	}
+	for i := 0; i < int(pkt.Count); i++ {
+		b := data[i*24:]
+		lost := binary.BigEndian.Uint32(b[4:])
+		pkt.Reports = append(pkt.Reports, RTCPReportBlock{
+			SSRC:           binary.BigEndian.Uint32(b),
+			FractionLost:   uint8(lost >> 24),
+			CumulativeLost: int32(lost<<8) >> 8,
+			HighestSeq:     binary.BigEndian.Uint32(b[8:]),
+			Jitter:         binary.BigEndian.Uint32(b[12:]),
+			LSR:            binary.BigEndian.Uint32(b[16:]),
+			DLSR:           binary.BigEndian.Uint32(b[20:]),
+		})
+	}
+	return nil
+}
+
+// parseSDES 每个chunk是ssrc + 若干item, 以类型0结束, 按4字节对齐
+func (pkt *RTCPPacket) parseSDES(body []byte) error {
+	pkt.CNames = map[uint32]string{}
+	pos := 0
+	for i := 0; i < int(pkt.Count); i++ {
+		if pos+4 > len(body) {
+			return ErrCheckRTCP
+		}
+		ssrc := binary.BigEndian.Uint32(body[pos:])
+		pos += 4
+		for pos < len(body) {
+			itemType := body[pos]
+			if itemType == sdesEnd {
+				pos++
+				break
+			}
+			if pos+2 > len(body) || pos+2+int(body[pos+1]) > len(body) {
+				return ErrCheckRTCP
+			}
+			text := body[pos+2 : pos+2+int(body[pos+1])]
+			if itemType == sdesCNAME {
+				pkt.CNames[ssrc] = string(text)
+			}
+			pos += 2 + len(text)
+		}
+		pos = (pos + 3) &^ 3
+	}
+	return nil
+}
+
+// parseFCI 反馈报文的FCI, NACK是PID+BLP, FIR是ssrc+序列号
+func (pkt *RTCPPacket) parseFCI(fci []byte) {
+	switch {
+	case pkt.PT == RTCPTypeRTPFB && pkt.Count == rtcpFmtNACK:
+		for ; len(fci) >= 4; fci = fci[4:] {
+			pid := binary.BigEndian.Uint16(fci)
+			blp := binary.BigEndian.Uint16(fci[2:])
+			pkt.NackSeqs = append(pkt.NackSeqs, pid)
+			for i := uint16(0); i < 16; i++ {
+				if blp&(1<<i) != 0 {
+					pkt.NackSeqs = append(pkt.NackSeqs, pid+i+1)
+				}
+			}
+		}
+	case pkt.PT == RTCPTypePSFB && pkt.Count == rtcpFmtFIR:
+		for ; len(fci) >= 8; fci = fci[8:] {
+			pkt.FirSSRCs = append(pkt.FirSSRCs, binary.BigEndian.Uint32(fci))
+		}
+	}
+}
+
+// TypeName 包类型的名字, 反馈报文按fmt区分
+func (pkt *RTCPPacket) TypeName() string {
+	switch pkt.PT {
+	case RTCPTypeSR:
+		return "SR"
+	case RTCPTypeRR:
+		return "RR"
+	case RTCPTypeSDES:
+		return "SDES"
+	case RTCPTypeBYE:
+		return "BYE"
+	case RTCPTypeAPP:
+		return "APP"
+	case RTCPTypeRTPFB:
+		if pkt.Count == rtcpFmtNACK {
+			return "NACK"
+		}
+		return fmt.Sprintf("RTPFB(%d)", pkt.Count)
+	case RTCPTypePSFB:
+		switch pkt.Count {
+		case rtcpFmtPLI:
+			return "PLI"
+		case rtcpFmtFIR:
+			return "FIR"
+		}
+		return fmt.Sprintf("PSFB(%d)", pkt.Count)
+	}
+	return fmt.Sprintf("PT(%d)", pkt.PT)
+}
+
+func (pkt *RTCPPacket) String() string {
+	s := pkt.TypeName()
+	switch pkt.PT {
+	case RTCPTypeSR:
+		s += fmt.Sprintf(" ssrc: %d ntp: %s rtp: %d pkts: %d octets: %d", pkt.SSRC,
+			ntpToTime(pkt.NTPTime).Format("15:04:05.000000"), pkt.RTPTime, pkt.PacketCount, pkt.OctetCount)
+	case RTCPTypeRR:
+		s += fmt.Sprintf(" ssrc: %d", pkt.SSRC)
+	case RTCPTypeSDES:
+		for ssrc, cname := range pkt.CNames {
+			s += fmt.Sprintf(" ssrc: %d cname: %s", ssrc, cname)
+		}
+	case RTCPTypeBYE:
+		s += fmt.Sprintf(" ssrc: %v reason: %q", pkt.ByeSSRCs, pkt.Reason)
+	case RTCPTypeAPP:
+		s += fmt.Sprintf(" ssrc: %d name: %s", pkt.SSRC, pkt.Name)
+	case RTCPTypeRTPFB, RTCPTypePSFB:
+		s += fmt.Sprintf(" ssrc: %d media ssrc: %d", pkt.SSRC, pkt.MediaSSRC)
+		if len(pkt.NackSeqs) > 0 {
+			s += fmt.Sprintf(" seqs: %v", pkt.NackSeqs)
+		}
+		if len(pkt.FirSSRCs) > 0 {
+			s += fmt.Sprintf(" fir ssrc: %v", pkt.FirSSRCs)
+		}
+	}
+	for _, report := range pkt.Reports {
+		s += fmt.Sprintf("\n\t\treport ssrc: %d fraction lost: %d/256 cumulative lost: %d highest seq: %d jitter: %d lsr: 0x%x dlsr: 0x%x",
+			report.SSRC, report.FractionLost, report.CumulativeLost, report.HighestSeq, report.Jitter, report.LSR, report.DLSR)
+	}
+	return s
+}
+
+// ntpToTime 64位NTP时间戳转为时间, 高32位是秒, 低32位是小数
+func ntpToTime(ntp uint64) time.Time {
+	sec := int64(ntp>>32) - ntpUnixOffset
+	nsec := int64((ntp & 0xffffffff) * 1e9 >> 32)
+	return time.Unix(sec, nsec).UTC()
+}
+
+// ntpMiddle NTP时间戳的中间32位, LSR用的格式
+func ntpMiddle(ntp uint64) uint32 {
+	return uint32(ntp >> 16)
+}
+
+// senderReport SR中的NTP时间和rtp时间戳的对应关系
+type senderReport struct {
+	ntp         uint64
+	rtpTime     uint32
+	packetCount uint32
+	octetCount  uint32
+	pos         int64
+}
+
+// rtcpInfo 一个ssrc相关的rtcp统计, 包括它自己发的SR和别人对它的报告和反馈
+type rtcpInfo struct {
+	ssrc    uint32
+	cname   string
+	srCount uint32
+	firstSR senderReport
+	lastSR  senderReport
+	// SR的NTP中间32位 -> 抓到这个SR的时间, 用来算rtt
+	srArrivals map[uint32]time.Time
+	// 接收端对这个流的报告
+	reportCount uint32
+	lastReport  RTCPReportBlock
+	maxLost     int32
+	maxFraction uint8
+	// 根据抓包时间算的rtt, 抓包点离这个流的发送端越近越准确
+	rttCount uint32
+	minRTT   time.Duration
+	maxRTT   time.Duration
+	lastRTT  time.Duration
+	// 反馈报文
+	nackCount    uint32
+	nackSeqCount uint32
+	pliCount     uint32
+	firCount     uint32
+	appCount     uint32
+	byeCount     uint32
+	byeReason    string
+}
+
+// getRTCPInfo 返回ssrc对应的rtcp统计, 配置了ssrc过滤时其他的ssrc返回nil
+func (decoder *RTPDecoder) getRTCPInfo(ssrc uint32) *rtcpInfo {
+	if len(decoder.ssrcFilter) > 0 && !decoder.ssrcFilter[ssrc] {
+		return nil
+	}
+	if info, ok := decoder.rtcp[ssrc]; ok {
+		return info
+	}
+	info := &rtcpInfo{
+		ssrc:       ssrc,
+		srArrivals: map[uint32]time.Time{},
+	}
+	decoder.rtcp[ssrc] = info
+	decoder.rtcpList = append(decoder.rtcpList, info)
+	return info
+}
+
+// decodeRTCP 解析一个rtcp复合包, 按ssrc记到对应的流上
+func (decoder *RTPDecoder) decodeRTCP(frame *Frame) {
+	decoder.rtcpCount++
+	pkts, err := parseRTCP(frame.Data)
+	if err != nil {
+		log.Println("check rtcp error, pos:", frame.Offset, "len:", len(frame.Data), "parsed:", len(pkts))
+	}
+	for _, pkt := range pkts {
+		if decoder.param.Verbose {
+			log.Println("rtcp:", pkt.String())
+		}
+		decoder.updateRTCPInfo(pkt, frame)
+	}
+}
+
+func (decoder *RTPDecoder) updateRTCPInfo(pkt *RTCPPacket, frame *Frame) {
+	switch pkt.PT {
+	case RTCPTypeSR:
+		if info := decoder.getRTCPInfo(pkt.SSRC); info != nil {
+			sr := senderReport{
+				ntp:         pkt.NTPTime,
+				rtpTime:     pkt.RTPTime,
+				packetCount: pkt.PacketCount,
+				octetCount:  pkt.OctetCount,
+				pos:         frame.Offset,
+			}
+			if info.srCount == 0 {
+				info.firstSR = sr
+			}
+			info.lastSR = sr
+			info.srCount++
+			if !frame.Timestamp.IsZero() {
+				info.srArrivals[ntpMiddle(pkt.NTPTime)] = frame.Timestamp
+			}
+		}
+	case RTCPTypeSDES:
+		for ssrc, cname := range pkt.CNames {
+			if info := decoder.getRTCPInfo(ssrc); info != nil {
+				info.cname = cname
+			}
+		}
+	case RTCPTypeBYE:
+		for _, ssrc := range pkt.ByeSSRCs {
+			if info := decoder.getRTCPInfo(ssrc); info != nil {
+				info.byeCount++
+				info.byeReason = pkt.Reason
+			}
+		}
+	case RTCPTypeAPP:
+		if info := decoder.getRTCPInfo(pkt.SSRC); info != nil {
+			info.appCount++
+		}
+	case RTCPTypeRTPFB:
+		if info := decoder.getRTCPInfo(pkt.MediaSSRC); info != nil && pkt.Count == rtcpFmtNACK {
+			info.nackCount++
+			info.nackSeqCount += uint32(len(pkt.NackSeqs))
+		}
+	case RTCPTypePSFB:
+		switch pkt.Count {
+		case rtcpFmtPLI:
+			if info := decoder.getRTCPInfo(pkt.MediaSSRC); info != nil {
+				info.pliCount++
+			}
+		case rtcpFmtFIR:
+			for _, ssrc := range pkt.FirSSRCs {
+				if info := decoder.getRTCPInfo(ssrc); info != nil {
+					info.firCount++
+				}
+			}
+		}
+	}
+	for _, report := range pkt.Reports {
+		if info := decoder.getRTCPInfo(report.SSRC); info != nil {
+			info.addReport(report, frame.Timestamp)
+		}
+	}
+}
+
+// addReport 记录接收端对这个流的报告. RFC 3550 6.4.1 rtt = A - LSR - DLSR,
+// 发送端的NTP时钟和抓包的时钟不一定一致, 这里用抓到LSR对应的SR的时间代替LSR
+func (info *rtcpInfo) addReport(report RTCPReportBlock, arrival time.Time) {
+	info.reportCount++
+	info.lastReport = report
+	if report.CumulativeLost > info.maxLost {
+		info.maxLost = report.CumulativeLost
+	}
+	if report.FractionLost > info.maxFraction {
+		info.maxFraction = report.FractionLost
+	}
+	srArrival, ok := info.srArrivals[report.LSR]
+	if arrival.IsZero() || report.LSR == 0 || !ok {
+		return
+	}
+	d := arrival.Sub(srArrival) - time.Duration(int64(report.DLSR)*int64(time.Second)>>16)
+	if d < 0 {
+		return
+	}
+	if info.rttCount == 0 || d < info.minRTT {
+		info.minRTT = d
+	}
+	if d > info.maxRTT {
+		info.maxRTT = d
+	}
+	info.lastRTT = d
+	info.rttCount++
+}
+
+func (info *rtcpInfo) dump(clockRate uint32) {
+	if info.cname != "" {
+		log.Println("\tcname:", info.cname)
+	}
+	log.Println("\tsr count:", info.srCount)
+	if info.srCount > 0 {
+		first, last := info.firstSR, info.lastSR
+		log.Printf("\t\tfirst sr: ntp %s rtp %d pos: %d(0x%x)", ntpToTime(first.ntp).Format(time.RFC3339Nano), first.rtpTime, first.pos, first.pos)
+		log.Printf("\t\tlast sr: ntp %s rtp %d pos: %d(0x%x)", ntpToTime(last.ntp).Format(time.RFC3339Nano), last.rtpTime, last.pos, last.pos)
+		log.Println("\t\tsender pkt count:", last.packetCount, "octet count:", last.octetCount)
+		// 两个SR之间rtp时间戳的增量除以NTP时间的增量, 就是发送端实际的时钟频率
+		ntpDiff := ntpToTime(last.ntp).Sub(ntpToTime(first.ntp)).Seconds()
+		if ntpDiff > 0 {
+			log.Printf("\t\tsr clock rate: %.1f", float64(int32(last.rtpTime-first.rtpTime))/ntpDiff)
+		}
+	}
+	log.Println("\treceiver report count:", info.reportCount)
+	if info.reportCount > 0 {
+		report := info.lastReport
+		log.Printf("\t\tlast fraction lost: %.2f%% max: %.2f%%", float64(report.FractionLost)*100/256, float64(info.maxFraction)*100/256)
+		log.Println("\t\tlast cumulative lost:", report.CumulativeLost, "max:", info.maxLost)
+		log.Println("\t\tlast highest seq:", report.HighestSeq&0xffff, "cycles:", report.HighestSeq>>16)
+		if clockRate > 0 {
+			log.Printf("\t\tlast jitter: %d (%.3fms)", report.Jitter, float64(report.Jitter)*1000/float64(clockRate))
+		}
+		if info.rttCount > 0 {
+			log.Printf("\t\trtt: last %v min %v max %v", info.lastRTT, info.minRTT, info.maxRTT)
+		}
+	}
+	log.Println("\tnack count:", info.nackCount, "nack seq count:", info.nackSeqCount)
+	log.Println("\tpli count:", info.pliCount)
+	log.Println("\tfir count:", info.firCount)
+	if info.appCount > 0 {
+		log.Println("\tapp count:", info.appCount)
+	}
+	if info.byeCount > 0 {
+		log.Printf("\tbye reason: %q", info.byeReason)
+	}
+}
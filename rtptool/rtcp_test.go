@@ -0,0 +1,59 @@
+package rtptool
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// byePacket 一个ssrc的BYE包, reasonLen为负时不带原因, 长度补齐到4字节
+func byePacket(reasonLen int, reason []byte) []byte {
+	body := []byte{0x00, 0x00, 0x12, 0x34}
+	if reasonLen >= 0 {
+		body = append(body, byte(reasonLen))
+		body = append(body, reason...)
+	}
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	pkt := []byte{0x81, RTCPTypeBYE, 0, 0}
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(body)/4))
+	return append(pkt, body...)
+}
+
+func TestParseRTCPByeReason(t *testing.T) {
+	long := bytes.Repeat([]byte{'x'}, 255)
+	tests := []struct {
+		name    string
+		data    []byte
+		reason  string
+		wantErr bool
+	}{
+		{name: "no reason", data: byePacket(-1, nil)},
+		{name: "reason", data: byePacket(8, []byte("shutdown")), reason: "shutdown"},
+		{name: "empty reason", data: byePacket(0, nil)},
+		{name: "255 byte reason", data: byePacket(255, long), reason: string(long)},
+		{name: "reason longer than pkt", data: byePacket(255, long[:10]), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkts, err := parseRTCP(tt.data)
+			if tt.wantErr {
+				if err != ErrCheckRTCP {
+					t.Fatalf("err: got %v, want %v", err, ErrCheckRTCP)
+				}
+				return
+			}
+			if err != nil || len(pkts) != 1 {
+				t.Fatalf("got %d pkts, err: %v", len(pkts), err)
+			}
+			pkt := pkts[0]
+			if len(pkt.ByeSSRCs) != 1 || pkt.ByeSSRCs[0] != 0x1234 {
+				t.Errorf("bye ssrc: got %v", pkt.ByeSSRCs)
+			}
+			if pkt.Reason != tt.reason {
+				t.Errorf("reason: got %q, want %q", pkt.Reason, tt.reason)
+			}
+		})
+	}
+}
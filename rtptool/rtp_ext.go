@@ -0,0 +1,184 @@
+package rtptool
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// RFC 8285 one-byte header
+	extProfileOneByte = 0xbede
+	// RFC 8285 two-byte header, 低4位是appbits
+	extProfileTwoByte     = 0x1000
+	extProfileTwoByteMask = 0xfff0
+)
+
+const (
+	ExtAbsSendTime      = "abs-send-time"
+	ExtTransportCC      = "transport-cc"
+	ExtVideoOrientation = "video-orientation"
+	ExtAudioLevel       = "audio-level"
+	ExtTimeOffset       = "toffset"
+	ExtPlayoutDelay     = "playout-delay"
+	ExtMid              = "mid"
+	ExtRtpStreamID      = "rtp-stream-id"
+	ExtRepairedStreamID = "repaired-rtp-stream-id"
+)
+
+var ErrCheckExtMap = errors.New("check rtp extension map error")
+
+// sdp中a=extmap的uri到简称的映射
+var extURIs = map[string]string{
+	"http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time":                ExtAbsSendTime,
+	"http://www.ietf.org/id/draft-holmer-rmcat-transport-wide-cc-extensions-01": ExtTransportCC,
+	"urn:3gpp:video-orientation":                                                ExtVideoOrientation,
+	"urn:ietf:params:rtp-hdrext:ssrc-audio-level":                               ExtAudioLevel,
+	"urn:ietf:params:rtp-hdrext:toffset":                                        ExtTimeOffset,
+	"http://www.webrtc.org/experiments/rtp-hdrext/playout-delay":                ExtPlayoutDelay,
+	"urn:ietf:params:rtp-hdrext:sdes:mid":                                       ExtMid,
+	"urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id":                             ExtRtpStreamID,
+	"urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id":                    ExtRepairedStreamID,
+}
+
+// RTPExtension RFC 8285的一个扩展元素
+type RTPExtension struct {
+	ID   uint8
+	Name string
+	Data []byte
+}
+
+// ParseExtMap 解析 "1=abs-send-time,3=transport-cc" 形式的扩展id映射,
+// 名字可以是简称, 也可以是sdp里a=extmap的uri
+func ParseExtMap(s string) (map[uint8]string, error) {
+	extMap := map[uint8]string{}
+	if s == "" {
+		return extMap, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(kv) != 2 {
+			log.Println("check ext map item error:", item)
+			return nil, ErrCheckExtMap
+		}
+		id, err := strconv.Atoi(kv[0])
+		if err != nil || id < 1 || id > 255 {
+			log.Println("check ext map id error:", item)
+			return nil, ErrCheckExtMap
+		}
+		name := kv[1]
+		if short, ok := extURIs[name]; ok {
+			name = short
+		}
+		extMap[uint8(id)] = name
+	}
+	return extMap, nil
+}
+
+// extMapIDs 按id排序, csv的列按这个顺序输出
+func extMapIDs(extMap map[uint8]string) []uint8 {
+	ids := []uint8{}
+	for id := range extMap {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// parseExtElements 解析扩展头的内容, 不是RFC 8285的profile返回nil
+func parseExtElements(profile uint16, data []byte, extMap map[uint8]string) ([]RTPExtension, error) {
+	var exts []RTPExtension
+	oneByte := profile == extProfileOneByte
+	if !oneByte && profile&extProfileTwoByteMask != extProfileTwoByte {
+		return nil, nil
+	}
+	for len(data) > 0 {
+		var id uint8
+		var elemLen int
+		if oneByte {
+			id = data[0] >> 4
+			elemLen = int(data[0]&0x0f) + 1
+			// id为0是填充, 15表示后面的不要再解析了
+			if id == 0 {
+				data = data[1:]
+				continue
+			}
+			if id == 15 {
+				break
+			}
+			data = data[1:]
+		} else {
+			id = data[0]
+			if id == 0 {
+				data = data[1:]
+				continue
+			}
+			if len(data) < 2 {
+				return exts, ErrCheckRTP
+			}
+			elemLen = int(data[1])
+			data = data[2:]
+		}
+		if elemLen > len(data) {
+			return exts, ErrCheckRTP
+		}
+		exts = append(exts, RTPExtension{
+			ID:   id,
+			Name: extMap[id],
+			Data: data[:elemLen],
+		})
+		data = data[elemLen:]
+	}
+	return exts, nil
+}
+
+// Value 解码后的值, 不认识的扩展输出hex
+func (ext *RTPExtension) Value() string {
+	d := ext.Data
+	switch ext.Name {
+	case ExtAbsSendTime:
+		if len(d) == 3 {
+			v := uint32(d[0])<<16 | uint32(d[1])<<8 | uint32(d[2])
+			return fmt.Sprintf("%.6f", float64(v)/(1<<18))
+		}
+	case ExtTransportCC:
+		if len(d) == 2 {
+			return fmt.Sprint(binary.BigEndian.Uint16(d))
+		}
+	case ExtVideoOrientation:
+		if len(d) == 1 {
+			return fmt.Sprintf("rotation=%d flip=%d back=%d", int(d[0]&0x03)*90, (d[0]>>2)&1, (d[0]>>3)&1)
+		}
+	case ExtAudioLevel:
+		if len(d) >= 1 {
+			return fmt.Sprintf("-%ddBov vad=%d", d[0]&0x7f, d[0]>>7)
+		}
+	case ExtTimeOffset:
+		if len(d) == 3 {
+			v := int32(uint32(d[0])<<24|uint32(d[1])<<16|uint32(d[2])<<8) >> 8
+			return fmt.Sprint(v)
+		}
+	case ExtPlayoutDelay:
+		if len(d) == 3 {
+			minDelay := int(d[0])<<4 | int(d[1])>>4
+			maxDelay := int(d[1]&0x0f)<<8 | int(d[2])
+			return fmt.Sprintf("min=%dms max=%dms", minDelay*10, maxDelay*10)
+		}
+	case ExtMid, ExtRtpStreamID, ExtRepairedStreamID:
+		return string(d)
+	}
+	return hex.EncodeToString(d)
+}
+
+func (ext *RTPExtension) String() string {
+	name := ext.Name
+	if name == "" {
+		name = "unknown"
+	}
+	return fmt.Sprintf("%d(%s):%s", ext.ID, name, ext.Value())
+}
@@ -1,6 +1,7 @@
 package rtptool
 
 import (
+	"bufio"
 	"bytes"
 	"dumpPayloadFromRTP/bitreader"
 	"encoding/binary"
@@ -9,9 +10,10 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -22,6 +24,8 @@ var (
 	ErrSendRTP         = errors.New("send rtp error")
 	ErrSendDone        = errors.New("send rtp done")
 	ErrCheckRtpLen     = errors.New("check rtp len error")
+	ErrCheckFilter     = errors.New("check filter error")
+	ErrCheckPadding    = errors.New("check rtp padding error")
 )
 
 type ConsoleParam struct {
@@ -45,59 +49,123 @@ type ConsoleParam struct {
 	verbose           bool
 	DumpPesStartBytes bool
 	DumpVideoFrameCnt int
+	PcapStream        int
+	Framing           string
+	ExtMap            string
+	CSRCFilter        string
+	SSRCFilter        string
+	ReorderWindow     int
+	ClockRate         int
+	ListenTCP         string
+	ListenUDP         string
+	DialTCP           string
+	RecordFile        string
+	StatsInterval     time.Duration
+	ParsePs           bool
+	Pace              string
+	PaceInterval      time.Duration
+	Speed             float64
+	Loop              int
+	StartSeq          int
+	StartOffset       int64
+	Rewrite           bool
+	RewriteSSRC       string
+	PsStart           string
+	PrintPesHeader    bool
+	PtsGap            time.Duration
+	AvSyncFile        string
+	AvJump            time.Duration
+	PsResync          bool
+	SendTransport     string
+	LocalAddr         string
+	LossRate          float64
+	GELoss            string
+	DupRate           float64
+	ReorderRate       float64
+	ReorderDepth      int
+	CorruptRate       float64
+	Delay             time.Duration
+	Jitter            time.Duration
+	ImpairSeed        int64
 }
 
 type RTPDecoder struct {
 	param          *ConsoleParam
-	fileBuf        *[]byte
-	fileSize       int
-	br             bitreader.BitReader
-	InputFile      *os.File
+	fileSize       int64
+	framer         Framer
+	frame          *Frame
 	OutputFile     *os.File
 	CsvFile        *os.File
-	streamSSRC     uint32
-	streamPT       uint32
-	firstSeqNum    uint32
-	lastSeqNum     uint32
+	streams        map[uint32]*RTPStream
+	streamList     []*RTPStream
 	pktCount       uint32
 	writeCsvHeader bool
-	conn           net.Conn
-	outputData     []byte
-	gotKey         bool
-	psmPos         uint32
+	sender         *rtpSender
+	extMap         map[uint8]string
+	extIDs         []uint8
+	csrcFilter     map[uint32]bool
+	ssrcFilter     map[uint32]bool
+	rtcp           map[uint32]*rtcpInfo
+	rtcpList       []*rtcpInfo
+	rtcpCount      uint32
+	// 版本号不是2或者长度不够rtp头的包, 多了说明-framing不对或者输入切分错了
+	framingErrCount uint32
+	psWriter        io.Writer
+	lastRolling     time.Time
 }
 
-func NewRTPDecoder(br bitreader.BitReader, fileBuf *[]byte, fileSize int, param *ConsoleParam) *RTPDecoder {
-	var conn net.Conn
-	var err error
-	if param.RemoteAddr != "" {
-		conn, err = net.Dial("tcp", param.RemoteAddr)
-		if err != nil {
-			log.Println(err)
+// NewRTPDecoder fileSize只用来显示进度, 输入是管道或者socket时为0
+func NewRTPDecoder(framer Framer, fileSize int64, param *ConsoleParam) *RTPDecoder {
+	extMap, err := ParseExtMap(param.ExtMap)
+	if err != nil {
+		return nil
+	}
+	csrcFilter, err := parseIDList(param.CSRCFilter)
+	if err != nil {
+		return nil
+	}
+	ssrcFilter, err := parseIDList(param.SSRCFilter)
+	if err != nil {
+		return nil
+	}
+	if param.PsStart != "" && checkPsStart(param.PsStart) != nil {
+		return nil
+	}
+	if param.ClockRate < 0 {
+		log.Println("check clock rate error:", param.ClockRate)
+		return nil
+	}
+	var sender *rtpSender
+	if param.RemoteAddr != "" || param.SendTransport == SendTCPPassive {
+		if sender, err = newRTPSender(param); err != nil {
 			return nil
 		}
 	}
 	decoder := &RTPDecoder{
-		fileBuf:        fileBuf,
 		fileSize:       fileSize,
 		param:          param,
-		br:             br,
+		framer:         framer,
 		writeCsvHeader: true,
-		conn:           conn,
-		outputData:     []byte{},
+		sender:         sender,
+		extMap:         extMap,
+		extIDs:         extMapIDs(extMap),
+		csrcFilter:     csrcFilter,
+		ssrcFilter:     ssrcFilter,
+		streams:        make(map[uint32]*RTPStream),
+		rtcp:           make(map[uint32]*rtcpInfo),
 	}
 	return decoder
 }
 
+// SetPsWriter 第一个流拼好的ps同时写到w, 用来边收边解析ps, 需要在DecodePkts之前调用
+func (decoder *RTPDecoder) SetPsWriter(w io.Writer) {
+	decoder.psWriter = w
+}
+
 func (decoder *RTPDecoder) OpenFiles() error {
 	var err error
-	decoder.InputFile, err = os.OpenFile(decoder.param.InputFile, os.O_WRONLY|os.O_CREATE, 0666)
-	if err != nil {
-		log.Println(err)
-		return err
-	}
 	if decoder.param.OutputFile != "" {
-		decoder.OutputFile, err = os.OpenFile(decoder.param.OutputFile, os.O_WRONLY|os.O_CREATE, 0666)
+		decoder.OutputFile, err = os.OpenFile(decoder.param.OutputFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 		if err != nil {
 			log.Println(err)
 			return err
@@ -113,9 +181,12 @@ func (decoder *RTPDecoder) OpenFiles() error {
 	return nil
 }
 
+// getPos 当前包在输入文件中的偏移
 func (decoder *RTPDecoder) getPos() int64 {
-	pos := decoder.br.Size() - int64(decoder.br.Len())
-	return pos
+	if decoder.frame == nil {
+		return 0
+	}
+	return decoder.frame.Offset
 }
 
 type RTP struct {
@@ -133,6 +204,8 @@ type RTP struct {
 	PT uint32
 	// 序列号,占16位，用于标识发送者所发送的RTP报文的序列号，每发送一个报文，序列号增1
 	seqNum uint32
+	// 扩展序列号, 高16位是序列号回绕的次数
+	extSeq uint32
 	// 时间戳(Timestamp)：占32位，时戳反映了该RTP报文的第一个八位组的采样时刻。接收者使用时戳来计算延迟和延迟抖动，并进行同步控制
 	timestamp uint32
 	// 同步信源(SSRC)标识符：占32位，用于标识同步信源。该标识符是随机选择的，参加同一视频会议的两个同步信源不能有相同的SSRC
@@ -141,123 +214,226 @@ type RTP struct {
 	CSRC   []uint32
 	hdrLen uint32
 	rtpLen uint32
+	// 扩展头的profile和长度(字节数, 不包括profile和长度本身), X=1时有效
+	ExtProfile uint32
+	ExtLen     uint32
+	// RFC 8285的扩展元素, profile不是0xBEDE/0x100X时为空
+	Extensions []RTPExtension
+	// 填充的长度, 包括最后一个表示长度的字节, P=0时为0
+	padLen  uint32
+	payload []byte
 }
 
-func (decoder *RTPDecoder) decodePkt() *RTP {
-	br := decoder.br
-	rtpLen, err := br.Read32(16)
-	if err != nil {
-		log.Println(err)
-		return nil
-	}
-	start := decoder.getPos()
-	V, _ := br.Read32(2)
-	P, _ := br.Read32(1)
-	X, _ := br.Read32(1)
-	CC, _ := br.Read32(4)
-	M, _ := br.Read32(1)
-	PT, _ := br.Read32(7)
-	seqNum, _ := br.Read32(16)
-	timestamp, _ := br.Read32(32)
-	SSRC, _ := br.Read32(32)
-	for i := 0; i < int(CC); i++ {
-		br.Skip(32)
-	}
-	end := decoder.getPos()
+func (decoder *RTPDecoder) decodePkt(frame *Frame) (*RTP, error) {
+	var err error
 	rtp := &RTP{
-		V:         V,
-		P:         P,
-		X:         X,
-		CC:        CC,
-		M:         M,
-		PT:        PT,
-		SSRC:      SSRC,
-		seqNum:    seqNum,
-		timestamp: timestamp,
-		hdrLen:    uint32(end - start),
-		rtpLen:    rtpLen,
-	}
-	decoder.pktCount++
-	return rtp
+		hdrLen: 12,
+		rtpLen: uint32(len(frame.Data)),
+	}
+	if rtp.rtpLen < rtp.hdrLen {
+		return rtp, nil
+	}
+	br := bitreader.NewReader(bytes.NewReader(frame.Data))
+	rtp.V, _ = br.Read32(2)
+	rtp.P, _ = br.Read32(1)
+	rtp.X, _ = br.Read32(1)
+	rtp.CC, _ = br.Read32(4)
+	rtp.M, _ = br.Read32(1)
+	rtp.PT, _ = br.Read32(7)
+	rtp.seqNum, _ = br.Read32(16)
+	rtp.timestamp, _ = br.Read32(32)
+	rtp.SSRC, _ = br.Read32(32)
+	rtp.hdrLen += rtp.CC * 4
+	if rtp.rtpLen < rtp.hdrLen {
+		return rtp, nil
+	}
+	for i := 0; i < int(rtp.CC); i++ {
+		csrc, _ := br.Read32(32)
+		rtp.CSRC = append(rtp.CSRC, csrc)
+	}
+	if rtp.X == 1 {
+		if rtp.rtpLen < rtp.hdrLen+4 {
+			rtp.hdrLen += 4
+			return rtp, nil
+		}
+		extHdr := frame.Data[rtp.hdrLen:]
+		rtp.ExtProfile = uint32(binary.BigEndian.Uint16(extHdr))
+		rtp.ExtLen = uint32(binary.BigEndian.Uint16(extHdr[2:])) * 4
+		rtp.hdrLen += 4 + rtp.ExtLen
+		if rtp.rtpLen < rtp.hdrLen {
+			return rtp, nil
+		}
+		rtp.Extensions, err = parseExtElements(uint16(rtp.ExtProfile), extHdr[4:4+rtp.ExtLen], decoder.extMap)
+		if err != nil {
+			log.Printf("check rtp extension error, profile: 0x%x len: %d seqNum: %d", rtp.ExtProfile, rtp.ExtLen, rtp.seqNum)
+		}
+	}
+	rtp.payload = frame.Data[rtp.hdrLen:]
+	if rtp.P == 1 && len(rtp.payload) > 0 {
+		// RFC 3550 5.1, 最后一个字节是填充的字节数, 包括它自己
+		rtp.padLen = uint32(rtp.payload[len(rtp.payload)-1])
+		if rtp.padLen != 0 && rtp.padLen <= uint32(len(rtp.payload)) {
+			rtp.payload = rtp.payload[:uint32(len(rtp.payload))-rtp.padLen]
+		}
+	}
+	return rtp, nil
+}
+
+// parseIDList 解析逗号分隔的ssrc/csrc列表, 支持10进制和0x开头的16进制
+func parseIDList(s string) (map[uint32]bool, error) {
+	ids := map[uint32]bool{}
+	if s == "" {
+		return ids, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		id, err := strconv.ParseUint(strings.TrimSpace(item), 0, 32)
+		if err != nil {
+			log.Println("check id error:", item)
+			return nil, ErrCheckFilter
+		}
+		ids[uint32(id)] = true
+	}
+	return ids, nil
 }
 
-func (decoder *RTPDecoder) skipInvalidBytes(rtp *RTP) error {
-	br := decoder.br
+// matchFilter 配置了ssrc过滤时只处理这些ssrc的包, 配置了csrc过滤时只处理包含其中某个csrc的包
+func (decoder *RTPDecoder) matchFilter(rtp *RTP) bool {
+	if len(decoder.ssrcFilter) > 0 && !decoder.ssrcFilter[rtp.SSRC] {
+		return false
+	}
+	if len(decoder.csrcFilter) == 0 {
+		return true
+	}
+	for _, csrc := range rtp.CSRC {
+		if decoder.csrcFilter[csrc] {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRTP 过滤条件和rtp头的检查, 不改统计也不打日志,
+// 首遍解析和循环发送都用它, 保证每一遍发出去的包是同一批
+func (decoder *RTPDecoder) checkRTP(rtp *RTP) error {
+	if !decoder.matchFilter(rtp) {
+		return ErrCheckFilter
+	}
+	if rtp.V != 2 {
+		return ErrCheckRTP
+	}
 	if rtp.rtpLen < rtp.hdrLen {
-		log.Println("check rtp len err, rtplen:", rtp.rtpLen, "hdrlen:", rtp.hdrLen, "pktcount:", decoder.pktCount)
 		return ErrCheckRtpLen
 	}
-	skipLen := rtp.rtpLen - rtp.hdrLen
-	skipBuf := make([]byte, skipLen)
-	if _, err := io.ReadAtLeast(br, skipBuf, int(skipLen)); err != nil {
-		log.Println("skip invalid bytes err:", err, "skip len: ", skipLen, "rtp len:", rtp.rtpLen, "header len:", rtp.hdrLen)
-		return err
+	if rtp.P == 1 && (rtp.padLen == 0 || rtp.padLen > rtp.rtpLen-rtp.hdrLen) {
+		return ErrCheckPadding
 	}
 	return nil
 }
 
-func (decoder *RTPDecoder) isRTPValid(rtp *RTP) bool {
-	if rtp.P == 1 {
-		log.Println("currently don't support decode P, pktCount:", decoder.pktCount, "seqNum:", rtp.seqNum)
+// isRTPValid checkErr是checkRTP的结果, 在这里打日志和计数
+func (decoder *RTPDecoder) isRTPValid(rtp *RTP, checkErr error) bool {
+	switch checkErr {
+	case nil:
+	case ErrCheckRTP:
+		log.Println("check rtp version err, version:", rtp.V, "pos:", decoder.getPos(), "pktcount:", decoder.pktCount)
+		decoder.framingErrCount++
 		return false
-	}
-	if rtp.X == 1 {
-		log.Println("currently don't support decode X, pktCount:", decoder.pktCount, "seqNum:", rtp.seqNum)
+	case ErrCheckRtpLen:
+		log.Println("check rtp len err, rtplen:", rtp.rtpLen, "hdrlen:", rtp.hdrLen, "pktcount:", decoder.pktCount)
+		decoder.framingErrCount++
 		return false
-	}
-	if decoder.streamSSRC == 0 {
-		decoder.streamSSRC = rtp.SSRC
-	} else if rtp.SSRC != decoder.streamSSRC {
-		log.Println("check SSRC error, old:", decoder.streamSSRC, "current:", rtp.SSRC,
-			"pos:", decoder.getPos(), "pktCount:", decoder.pktCount, "seqNum:", rtp.seqNum)
+	case ErrCheckPadding:
+		log.Println("check padding len err, padLen:", rtp.padLen, "rtplen:", rtp.rtpLen, "hdrlen:", rtp.hdrLen,
+			"pktCount:", decoder.pktCount, "seqNum:", rtp.seqNum)
+		return false
+	default:
 		return false
 	}
-	if decoder.streamPT == 0 {
-		decoder.streamPT = rtp.PT
-	} else if rtp.PT != decoder.streamPT {
-		log.Println("check PT error, old:", decoder.streamPT, "current:", rtp.PT)
+	stream, isNew := decoder.getStream(rtp)
+	if rtp.PT != stream.PT {
+		log.Println("check PT error, ssrc:", stream.SSRC, "old:", stream.PT, "current:", rtp.PT,
+			"pos:", decoder.getPos(), "pktCount:", decoder.pktCount, "seqNum:", rtp.seqNum)
 		return false
 	}
 	if decoder.param.Verbose {
 		log.Println("ssrc:", rtp.seqNum)
+		if len(rtp.CSRC) > 0 {
+			log.Println("\tcsrc:", rtp.CSRC)
+		}
+		for _, ext := range rtp.Extensions {
+			log.Println("\textension:", ext.String())
+		}
 	}
-	if decoder.lastSeqNum == 0 {
-		log.Println("first pkt seqNum:", rtp.seqNum)
-		decoder.firstSeqNum = rtp.seqNum
-		decoder.lastSeqNum = rtp.seqNum
-	} else if decoder.lastSeqNum+1 != rtp.seqNum {
-		log.Println("check seqNum error, last:", decoder.lastSeqNum, "current:", rtp.seqNum, "pktCount:", decoder.pktCount)
-		decoder.lastSeqNum = rtp.seqNum
-	} else {
-		decoder.lastSeqNum = rtp.seqNum
+	lastSeq := stream.seq.extendedMax()
+	expected := stream.seq.expected()
+	restarts := stream.seq.restarts
+	extSeq, ok := stream.seq.update(uint16(rtp.seqNum))
+	if !ok {
+		log.Println("seqNum jump too large, ssrc:", stream.SSRC, "last:", lastSeq&0xffff, "current:", rtp.seqNum, "pktCount:", decoder.pktCount)
+		return false
 	}
+	if stream.seq.restarts != restarts {
+		log.Println("seqNum restart, ssrc:", stream.SSRC, "last:", lastSeq&0xffff, "current:", rtp.seqNum, "pktCount:", decoder.pktCount)
+		stream.stats.restart(expected)
+		stream.restarted = true
+		isNew = true
+	}
+	rtp.extSeq = extSeq
+	stream.stats.update(extSeq, lastSeq, isNew, decoder.getPos())
+	stream.timing.update(rtp, decoder.frame.Timestamp)
+	if !isNew && lastSeq+1 != extSeq {
+		log.Println("check seqNum error, ssrc:", stream.SSRC, "last:", lastSeq&0xffff, "current:", rtp.seqNum, "pktCount:", decoder.pktCount)
+	}
+	stream.lastTimestamp = rtp.timestamp
+	stream.pktCount++
+	stream.byteCount += uint64(rtp.rtpLen)
 	return true
 }
 
 func (decoder *RTPDecoder) saveRTPPayload(rtp *RTP) error {
-	if decoder.OutputFile == nil {
+	if decoder.OutputFile == nil && decoder.psWriter == nil {
 		//log.Println("check outputfile err")
 		return nil
 	}
-	br := decoder.br
-	payloadLen := rtp.rtpLen - rtp.hdrLen
-	payloadData := make([]byte, payloadLen)
-	// TODO io.ReadAtLeast 很多组件都处理了，需要有一个统一的方案
-	if _, err := io.ReadAtLeast(br, payloadData, int(payloadLen)); err != nil {
-		log.Println(err)
-		return err
+	stream := decoder.streams[rtp.SSRC]
+	if stream.restarted {
+		// 对端重新开始, 之前的扩展序列号没有意义了, 先把缓存的包输出, 再从这个包重新排序
+		stream.restarted = false
+		if err := stream.flush(); err != nil {
+			return err
+		}
+		stream.reorder.reset()
+		stream.assembler.resetSeq()
 	}
-	if !decoder.gotKey {
-		if decoder.isKey(payloadData) {
-			decoder.gotKey = true
-			pos := decoder.getPackPos(payloadData)
-			data := payloadData[pos:]
-			decoder.outputData = append(decoder.outputData, data...)
-			log.Println("payload:", data)
+	for _, pkt := range stream.reorder.push(rtp) {
+		if err := stream.savePayload(pkt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush 把乱序缓存里的包和正在拼的帧输出
+func (stream *RTPStream) flush() error {
+	for _, pkt := range stream.reorder.flush() {
+		if err := stream.savePayload(pkt); err != nil {
+			return err
+		}
+	}
+	return stream.writeFrames(stream.assembler.flush())
+}
+
+// savePayload 按序列号顺序把负载按帧拼成ps流, 拼好一帧写一帧
+func (stream *RTPStream) savePayload(rtp *RTP) error {
+	return stream.writeFrames(stream.assembler.push(rtp))
+}
+
+func (stream *RTPStream) writeFrames(frames [][]byte) error {
+	for _, frame := range frames {
+		if err := stream.write(frame); err != nil {
+			return err
 		}
-		return nil
 	}
-	decoder.outputData = append(decoder.outputData, payloadData...)
 	return nil
 }
 
@@ -267,15 +443,25 @@ func (decoder *RTPDecoder) saveRTPInfo(rtp *RTP) error {
 		return nil
 	}
 	if decoder.writeCsvHeader {
-		header := "P, X, CC, M, PT, SeqNum, timestamp, SSRC, RTPLen\n"
+		header := "P, X, CC, M, PT, SeqNum, timestamp, SSRC, RTPLen, PayloadLen, PadLen, CSRC"
+		for _, id := range decoder.extIDs {
+			header += fmt.Sprintf(", %s(%d)", decoder.extMap[id], id)
+		}
+		header += "\n"
 		if _, err := decoder.CsvFile.Write([]byte(header)); err != nil {
 			log.Println(err)
 			return err
 		}
 		decoder.writeCsvHeader = false
 	}
-	data := fmt.Sprintf("%d, %d, %d, %d, %d, %d, %d, %d, %d\n", rtp.P, rtp.X, rtp.CC, rtp.M, rtp.PT,
-		rtp.seqNum, rtp.timestamp, rtp.SSRC, rtp.rtpLen)
+	// 多个csrc用空格分隔
+	csrcs := make([]string, len(rtp.CSRC))
+	for i, csrc := range rtp.CSRC {
+		csrcs[i] = fmt.Sprint(csrc)
+	}
+	data := fmt.Sprintf("%d, %d, %d, %d, %d, %d, %d, %d, %d, %d, %d, %s", rtp.P, rtp.X, rtp.CC, rtp.M, rtp.PT,
+		rtp.seqNum, rtp.timestamp, rtp.SSRC, rtp.rtpLen, len(rtp.payload), rtp.padLen, strings.Join(csrcs, " "))
+	data += decoder.extColumns(rtp) + "\n"
 	if _, err := decoder.CsvFile.Write([]byte(data)); err != nil {
 		log.Println(err)
 		return err
@@ -284,55 +470,39 @@ func (decoder *RTPDecoder) saveRTPInfo(rtp *RTP) error {
 
 }
 
-func (decoder *RTPDecoder) sendRTP(rtp *RTP) error {
-	if decoder.conn == nil {
-		return nil
-	}
-	curPos := decoder.getPos()
-	// 调用这个函数时rtp已经解析完了，buf位置已经动了
-	// 2个字节为rtp长度本身
-	start := uint32(curPos) - rtp.hdrLen - 2
-	end := start + rtp.rtpLen + 2
-	data := (*decoder.fileBuf)[start:end]
-	decoder.gotKey = true
-	if decoder.gotKey {
-		if decoder.pktCount > uint32(decoder.param.SendRtpCount) {
-			return ErrSendDone
-		}
-		if _, err := decoder.conn.Write(data); err != nil {
-			log.Println(err)
-			return ErrSendRTP
-		}
-	} else {
-		if decoder.isKey(data) {
-			decoder.gotKey = true
-			if _, err := decoder.conn.Write(data); err != nil {
-				log.Println(err)
-				return ErrSendRTP
+// extColumns csv中每个配置了的扩展一列, 没有这个扩展时为空
+func (decoder *RTPDecoder) extColumns(rtp *RTP) string {
+	columns := ""
+	for _, id := range decoder.extIDs {
+		value := ""
+		for _, ext := range rtp.Extensions {
+			if ext.ID == id {
+				value = ext.Value()
+				break
 			}
 		}
+		columns += ", " + value
 	}
-	// 移动buf指针
-	payloadLen := rtp.rtpLen - rtp.hdrLen
-	payloadData := make([]byte, payloadLen)
-	if _, err := io.ReadAtLeast(decoder.br, payloadData, int(payloadLen)); err != nil {
-		log.Println(err)
-		return err
+	return columns
+}
+
+// Sending 是否在发送rtp
+func (decoder *RTPDecoder) Sending() bool {
+	return decoder.sender != nil
+}
+
+func (decoder *RTPDecoder) sendRTP(rtp *RTP) error {
+	if decoder.sender == nil {
+		return nil
 	}
-	time.Sleep(5 * time.Millisecond)
-	return nil
+	return decoder.sender.send(rtp, decoder.frame)
 }
 
 func (decoder *RTPDecoder) SearchBytes(rtp *RTP) error {
 	if decoder.param.SearchBytes == "" {
 		return nil
 	}
-	curPos := decoder.getPos()
-	// 调用这个函数时rtp已经解析完了，buf位置已经动了
-	// 2个字节为rtp长度本身
-	start := uint32(curPos) - rtp.hdrLen - 2
-	end := start + rtp.rtpLen + 2
-	data := (*decoder.fileBuf)[start:end]
+	data := decoder.frame.Data
 	sep, err := hex.DecodeString(decoder.param.SearchBytes)
 	if err != nil {
 		log.Println("decode hex err")
@@ -349,35 +519,53 @@ func (decoder *RTPDecoder) SearchBytes(rtp *RTP) error {
 		if idx != -1 {
 			t = "video"
 		}
-		log.Println("seqNum:", rtp.seqNum, "timestamp:", rtp.timestamp,
+		stream := decoder.streams[rtp.SSRC]
+		log.Println("ssrc:", rtp.SSRC, "seqNum:", rtp.seqNum, "timestamp:", rtp.timestamp,
 			"PT:", rtp.PT, "rtplen:", rtp.rtpLen, "firstSeqNum:",
-			decoder.firstSeqNum, "count:", rtp.seqNum-decoder.firstSeqNum,
+			stream.seq.baseSeq, "count:", rtp.extSeq-stream.seq.baseSeq,
 			"type:", t)
 		os.Exit(0)
 	}
-	// 移动buf指针
-	payloadLen := rtp.rtpLen - rtp.hdrLen
-	payloadData := make([]byte, payloadLen)
-	if _, err := io.ReadAtLeast(decoder.br, payloadData, int(payloadLen)); err != nil {
-		log.Println(err)
-		return err
-	}
 	return nil
 }
 
 func (decoder *RTPDecoder) DecodePkts() error {
-	for decoder.getPos() < int64(decoder.fileSize) {
-		if decoder.param.ShowProgress {
-			fmt.Printf("\tparsing... %d/%d %d%%\r", decoder.getPos(), decoder.fileSize, (decoder.getPos()*100)/int64(decoder.fileSize))
+	for {
+		frame, err := decoder.framer.ReadFrame()
+		if err == io.EOF {
+			return decoder.flushReorder()
+		}
+		// 实时接收没有数据, 统计照样按时打印
+		if err == ErrFrameIdle {
+			decoder.rollingStats()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		decoder.frame = frame
+		decoder.rollingStats()
+		// rtcp-mux或者抓包中的rtcp流
+		if isRTCP(frame.Data) {
+			decoder.decodeRTCP(frame)
+			continue
+		}
+		decoder.pktCount++
+		rtp, err := decoder.decodePkt(frame)
+		if err != nil {
+			return err
+		}
+		checkErr := decoder.checkRTP(rtp)
+		if checkErr == ErrCheckFilter {
+			continue
+		}
+		if decoder.param.ShowProgress && decoder.fileSize > 0 {
+			fmt.Printf("\tparsing... %d/%d %d%%\r", decoder.getPos(), decoder.fileSize, (decoder.getPos()*100)/decoder.fileSize)
 		}
-		rtp := decoder.decodePkt()
 		if err := decoder.saveRTPInfo(rtp); err != nil {
 			return err
 		}
-		if !decoder.isRTPValid(rtp) {
-			if err := decoder.skipInvalidBytes(rtp); err != nil {
-				return err
-			}
+		if !decoder.isRTPValid(rtp, checkErr) {
 			continue
 		}
 		if err := decoder.saveRTPPayload(rtp); err != nil {
@@ -390,86 +578,116 @@ func (decoder *RTPDecoder) DecodePkts() error {
 			return err
 		}
 	}
-	return nil
 }
 
-func (decoder *RTPDecoder) Save() error {
-	if decoder.OutputFile != nil {
-		if _, err := decoder.OutputFile.Write(decoder.outputData); err != nil {
-			log.Println(err)
+// flushReorder 输入结束, 把乱序缓存里剩下的包拼到输出
+func (decoder *RTPDecoder) flushReorder() error {
+	if decoder.OutputFile == nil && decoder.psWriter == nil {
+		return nil
+	}
+	for _, stream := range decoder.streamList {
+		if err := stream.flush(); err != nil {
 			return err
 		}
-		decoder.OutputFile.Sync()
 	}
 	return nil
 }
 
-func (decoder *RTPDecoder) DumpStream() {
-	log.Println("ssrc:", decoder.streamSSRC)
-	log.Println("pt:", decoder.streamPT)
-	log.Println("first seq num:", decoder.firstSeqNum)
-	log.Println("last seq num:", decoder.lastSeqNum)
-	log.Println("pkt count:", decoder.pktCount)
-}
-
-func (decoder *RTPDecoder) isKey(data []byte) bool {
-	start := 0
-	end := len(data)
-	for start < end-4 {
-		buf := data[start : start+4]
-		packStartCode := binary.BigEndian.Uint32(buf)
-		if packStartCode == 0x000001bb {
-			log.Println("got psm pos:", start)
-			decoder.psmPos = uint32(start)
-			return true
+func (decoder *RTPDecoder) Save() error {
+	if decoder.OutputFile == nil {
+		return nil
+	}
+	// 第一个流写到-output-file, 其他的流各自一个文件
+	for _, stream := range decoder.streamList {
+		if err := stream.save(decoder.OutputFile); err != nil {
+			return err
 		}
-		start++
 	}
-	return false
+	return decoder.OutputFile.Sync()
 }
 
-func (decoder *RTPDecoder) getPackPos(data []byte) int {
-	start := 0
-	end := len(data)
-	for start < end-4 {
-		buf := data[start : start+4]
-		packStartCode := binary.BigEndian.Uint32(buf)
-		if packStartCode == 0x000001ba {
-			log.Println("got pack header pos:", start)
-			return start
+func (decoder *RTPDecoder) DumpStream() {
+	log.Println("stream count:", len(decoder.streamList))
+	for _, stream := range decoder.streamList {
+		stream.dump()
+		if info, ok := decoder.rtcp[stream.SSRC]; ok {
+			info.dump(stream.timing.clockRate)
 		}
-		start++
 	}
-	return -1
+	// 只在rtcp中出现的ssrc, 例如接收端自己的ssrc
+	for _, info := range decoder.rtcpList {
+		if _, ok := decoder.streams[info.ssrc]; ok {
+			continue
+		}
+		log.Println("rtcp only ssrc:", info.ssrc)
+		info.dump(uint32(decoder.param.ClockRate))
+	}
+	log.Println("pkt count:", decoder.pktCount)
+	log.Println("rtcp pkt count:", decoder.rtcpCount)
+	log.Println("framing error count:", decoder.framingErrCount)
+	if decoder.framingErrCount > 0 {
+		log.Println("\tinput may be split wrong, check -framing, current:", decoder.framer.Framing())
+	}
 }
 
-func (decoder *RTPDecoder) DumpOneFrame() {
-	buf := *decoder.fileBuf
-	start := 4
-	end := len(buf) - 4
-	for start < end {
-		if buf[start] == 0 && buf[start+1] == 0 && buf[start+2] == 0 && buf[start+3] == 1 && buf[start+4] == 0x41 {
+// DumpOneFrame 从h264文件中摘出第一帧, 也就是第一个P帧(nal 0x41)之前的数据, 边读边写
+func (decoder *RTPDecoder) DumpOneFrame(r io.Reader) error {
+	if decoder.OutputFile == nil {
+		return nil
+	}
+	pFrame := []byte{0x00, 0x00, 0x00, 0x01, 0x41}
+	br := bufio.NewReader(r)
+	w := bufio.NewWriter(decoder.OutputFile)
+	window := make([]byte, 0, len(pFrame))
+	// window[0]在输入中的偏移, 跳过开头的start code
+	pos := 0
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		window = append(window, b)
+		if len(window) < len(pFrame) {
+			continue
+		}
+		if pos >= 4 && bytes.Equal(window, pFrame) {
+			window = window[:0]
 			break
 		}
-		start++
+		w.WriteByte(window[0])
+		copy(window, window[1:])
+		window = window[:len(window)-1]
+		pos++
 	}
-	data := buf[:start]
-	decoder.outputData = append(decoder.outputData, data...)
+	w.Write(window)
+	return w.Flush()
 }
 
-func (decoder *RTPDecoder) pcapToRTPs(input, output string) (string, error) {
-	cmdstr := fmt.Sprintf("tshark -nlr %s -qz \"follow,tcp,raw,0\" | tail -n +7 | sed 's/^\\s\\+//g' | xxd -r -p > %s", input, output)
-	cmd := exec.Command("bash", "-c", cmdstr)
-	b, err := cmd.CombinedOutput()
+// RtpsToMPG rtp包转为mpg, 从r读rtp, 第一个流拼好的ps写到output, 其他的流写到output_<ssrc>
+func RtpsToMPG(r io.Reader, output string, param *ConsoleParam) error {
+	mpgParam := *param
+	mpgParam.OutputFile = output
+	framer, err := NewFramer(r, param.Framing, param.PcapStream)
 	if err != nil {
-		log.Println("cmd:", cmdstr, "err:", err)
-		return "", err
+		return err
 	}
-	return string(b), nil
-}
-
-// rtp包转为mpg
-func (decoder *RTPDecoder) rtpsToMPG(input, output string) {
+	decoder := NewRTPDecoder(framer, 0, &mpgParam)
+	if decoder == nil {
+		return ErrCheckRTP
+	}
+	if err := decoder.OpenFiles(); err != nil {
+		return err
+	}
+	if err := decoder.DecodePkts(); err != nil {
+		return err
+	}
+	decoder.Save()
+	decoder.DumpStream()
+	return nil
 }
 
 func (decoder *RTPDecoder) decodeOneH264(h264 []byte) {
@@ -0,0 +1,383 @@
+package rtptool
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// 不等待, 尽快发送
+	PaceNone = "none"
+	// 每个包之间固定间隔-pace-interval
+	PaceFixed = "fixed"
+	// 按rtp时间戳发送
+	PaceRTP = "rtp"
+	// 按抓包的到达时间发送, 输入没有到达时间时按rtp时间戳
+	PaceArrival = "arrival"
+)
+
+// 按时间戳发送时, 时间戳跳变超过这个时间就不再等, 从这个包重新开始计时
+const maxPaceGap = 5 * time.Second
+
+var ErrCheckPace = errors.New("check pace param error")
+
+// rtpSender 把rtp包发送给流媒体服务器, 控制发送速度, 需要时改写ssrc/序列号/时间戳
+type rtpSender struct {
+	targets []sendTarget
+	// udp的目的地共用这一个socket
+	udpConn   net.PacketConn
+	param     *ConsoleParam
+	pacer     pacer
+	impair    *impairer
+	delay     *delayLine
+	delayed   int
+	ssrc      uint32
+	rewriters map[uint32]*seqRewriter
+	// 到了-start-seq/-start-offset的位置后才开始发送
+	started bool
+	// 这一遍发了多少个包, -send-rtp-count按每一遍算
+	sent int
+}
+
+func newRTPSender(param *ConsoleParam) (*rtpSender, error) {
+	switch param.Pace {
+	case PaceNone, PaceFixed, PaceRTP, PaceArrival:
+	default:
+		log.Println("unknown pace:", param.Pace)
+		return nil, ErrCheckPace
+	}
+	if param.Speed <= 0 {
+		log.Println("check speed error:", param.Speed)
+		return nil, ErrCheckPace
+	}
+	var ssrc uint64
+	if param.RewriteSSRC != "" {
+		var err error
+		ssrc, err = strconv.ParseUint(param.RewriteSSRC, 0, 32)
+		if err != nil {
+			log.Println("check rewrite ssrc error:", param.RewriteSSRC)
+			return nil, ErrCheckPace
+		}
+	}
+	impair, err := newImpairer(param)
+	if err != nil {
+		return nil, err
+	}
+	targets, udpConn, err := openTargets(param)
+	if err != nil {
+		return nil, err
+	}
+	s := &rtpSender{
+		targets:   targets,
+		udpConn:   udpConn,
+		param:     param,
+		pacer:     newPacer(param),
+		impair:    impair,
+		ssrc:      uint32(ssrc),
+		rewriters: map[uint32]*seqRewriter{},
+	}
+	if s.delay, err = newDelayLine(param, s.deliver); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// send 发送一个包, 去掉填充后发给每一个目的地
+func (s *rtpSender) send(rtp *RTP, frame *Frame) error {
+	if !s.ready(rtp, frame) {
+		return nil
+	}
+	if s.param.SendRtpCount > 0 && s.sent >= s.param.SendRtpCount {
+		return ErrSendDone
+	}
+	pkt := make([]byte, 0, int(rtp.hdrLen)+len(rtp.payload))
+	pkt = append(pkt, frame.Data[:rtp.hdrLen]...)
+	// 去掉填充, 清掉P标志
+	pkt[0] &^= 0x20
+	pkt = append(pkt, rtp.payload...)
+	s.rewrite(pkt, rtp)
+	s.pacer.wait(rtp, frame.Timestamp, clockRateOf(rtp.PT, s.param.ClockRate))
+	pkts := [][]byte{pkt}
+	if s.impair != nil {
+		pkts = s.impair.process(pkt, int(rtp.hdrLen))
+	}
+	for _, pkt := range pkts {
+		if err := s.output(pkt); err != nil {
+			return err
+		}
+	}
+	s.sent++
+	return nil
+}
+
+// output 配置了延时的包交给delayLine, 到时间再发
+func (s *rtpSender) output(pkt []byte) error {
+	if s.delay == nil {
+		return s.deliver(pkt)
+	}
+	s.delayed++
+	return s.delay.push(pkt, s.delayed)
+}
+
+// deliver 发给每一个目的地, 一个目的地发送失败时不再发给它, 其他的继续
+func (s *rtpSender) deliver(pkt []byte) error {
+	targets := s.targets[:0]
+	for _, target := range s.targets {
+		if err := target.write(pkt); err != nil {
+			log.Println("send to", target, "error:", err)
+			continue
+		}
+		targets = append(targets, target)
+	}
+	s.targets = targets
+	if len(s.targets) == 0 {
+		return ErrSendRTP
+	}
+	return nil
+}
+
+// close 发完乱序推迟和延时的包, 打印损伤的统计, 关闭连接
+func (s *rtpSender) close() error {
+	var err error
+	if s.impair != nil {
+		for _, pkt := range s.impair.flush() {
+			if err = s.output(pkt); err != nil {
+				break
+			}
+		}
+		s.impair.dump()
+	}
+	if s.delay != nil {
+		if delayErr := s.delay.close(); err == nil {
+			err = delayErr
+		}
+	}
+	for _, target := range s.targets {
+		target.close()
+	}
+	if s.udpConn != nil {
+		s.udpConn.Close()
+	}
+	return err
+}
+
+// ready 跳过-start-seq/-start-offset之前的包
+func (s *rtpSender) ready(rtp *RTP, frame *Frame) bool {
+	if s.started {
+		return true
+	}
+	if s.param.StartSeq >= 0 && rtp.seqNum != uint32(s.param.StartSeq) {
+		return false
+	}
+	if frame.Offset < s.param.StartOffset {
+		return false
+	}
+	log.Println("start sending at seqNum:", rtp.seqNum, "pos:", frame.Offset)
+	s.started = true
+	return true
+}
+
+func (s *rtpSender) rewrite(pkt []byte, rtp *RTP) {
+	if s.param.Rewrite {
+		w, ok := s.rewriters[rtp.SSRC]
+		if !ok {
+			w = &seqRewriter{tsStep: clockRateOf(rtp.PT, s.param.ClockRate) / 25}
+			s.rewriters[rtp.SSRC] = w
+		}
+		seq, ts := w.rewrite(uint16(rtp.seqNum), rtp.timestamp)
+		binary.BigEndian.PutUint16(pkt[2:], seq)
+		binary.BigEndian.PutUint32(pkt[4:], ts)
+	}
+	if s.ssrc != 0 {
+		binary.BigEndian.PutUint32(pkt[8:], s.ssrc)
+	}
+}
+
+// nextLoop 开始新的一遍, 序列号和时间戳接着上一遍
+func (s *rtpSender) nextLoop() {
+	s.started = false
+	s.sent = 0
+	s.pacer.reset()
+	for _, w := range s.rewriters {
+		w.newLoop = true
+	}
+}
+
+// seqRewriter 改写一个流的序列号和时间戳, 循环发送时新的一遍接着上一遍,
+// 接收端看到的是一个连续的流
+type seqRewriter struct {
+	started   bool
+	newLoop   bool
+	seqOffset uint16
+	tsOffset  uint32
+	// 上一个发出去的包改写后的序列号和时间戳
+	lastSeq uint16
+	lastTs  uint32
+	// 最近一次时间戳的增量, 新的一遍的第一个包按这个增量接着
+	tsStep uint32
+}
+
+func (w *seqRewriter) rewrite(seq uint16, ts uint32) (uint16, uint32) {
+	if w.newLoop {
+		w.seqOffset = w.lastSeq + 1 - seq
+		w.tsOffset = w.lastTs + w.tsStep - ts
+		w.newLoop = false
+	}
+	outSeq := seq + w.seqOffset
+	outTs := ts + w.tsOffset
+	if w.started && int32(outTs-w.lastTs) > 0 {
+		w.tsStep = outTs - w.lastTs
+	}
+	w.started = true
+	w.lastSeq = outSeq
+	w.lastTs = outTs
+	return outSeq, outTs
+}
+
+// pacer 控制发送速度
+type pacer struct {
+	mode     string
+	interval time.Duration
+	speed    float64
+	// 按到达时间发送
+	startWall    time.Time
+	firstArrival time.Time
+	// 按rtp时间戳发送, 每个ssrc单独计时
+	streams     map[uint32]*paceStream
+	warnArrival bool
+}
+
+type paceStream struct {
+	baseWall  time.Time
+	extTs     int64
+	lastRawTs uint32
+}
+
+func newPacer(param *ConsoleParam) pacer {
+	return pacer{
+		mode:     param.Pace,
+		interval: param.PaceInterval,
+		speed:    param.Speed,
+		streams:  map[uint32]*paceStream{},
+	}
+}
+
+func (p *pacer) reset() {
+	p.startWall = time.Time{}
+	p.firstArrival = time.Time{}
+	p.streams = map[uint32]*paceStream{}
+}
+
+// wait 等到这个包应该发送的时间
+func (p *pacer) wait(rtp *RTP, arrival time.Time, clockRate uint32) {
+	switch p.mode {
+	case PaceNone:
+		return
+	case PaceFixed:
+		time.Sleep(p.interval)
+		return
+	case PaceArrival:
+		if !arrival.IsZero() {
+			p.waitArrival(arrival)
+			return
+		}
+		if !p.warnArrival {
+			log.Println("no arrival time in input, pace by rtp timestamp")
+			p.warnArrival = true
+		}
+	}
+	p.waitTimestamp(rtp, clockRate)
+}
+
+func (p *pacer) waitArrival(arrival time.Time) {
+	now := time.Now()
+	if p.startWall.IsZero() {
+		p.startWall = now
+		p.firstArrival = arrival
+		return
+	}
+	target := p.startWall.Add(time.Duration(float64(arrival.Sub(p.firstArrival)) / p.speed))
+	p.sleepUntil(now, target, func() {
+		p.startWall = now
+		p.firstArrival = arrival
+	})
+}
+
+func (p *pacer) waitTimestamp(rtp *RTP, clockRate uint32) {
+	now := time.Now()
+	stream, ok := p.streams[rtp.SSRC]
+	if !ok {
+		p.streams[rtp.SSRC] = &paceStream{
+			baseWall:  now,
+			lastRawTs: rtp.timestamp,
+		}
+		return
+	}
+	stream.extTs += int64(int32(rtp.timestamp - stream.lastRawTs))
+	stream.lastRawTs = rtp.timestamp
+	media := time.Duration(float64(stream.extTs) / float64(clockRate) / p.speed * float64(time.Second))
+	p.sleepUntil(now, stream.baseWall.Add(media), func() {
+		stream.baseWall = now
+		stream.extTs = 0
+	})
+}
+
+// sleepUntil 时间差太大说明输入的时间跳变了, 调用rebase从当前包重新计时
+func (p *pacer) sleepUntil(now, target time.Time, rebase func()) {
+	d := target.Sub(now)
+	if d > maxPaceGap || d < -maxPaceGap {
+		log.Println("pace time jump:", d, "restart timing")
+		rebase()
+		return
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// CloseSender 发送结束, 等延时的包发完后关闭连接
+func (decoder *RTPDecoder) CloseSender() {
+	if decoder.sender == nil {
+		return
+	}
+	if err := decoder.sender.close(); err != nil {
+		log.Println(err)
+	}
+	decoder.sender = nil
+}
+
+// Replay 循环发送时从第二遍开始调用, 只发送, 不再做统计和输出
+func (decoder *RTPDecoder) Replay(framer Framer) error {
+	if decoder.sender == nil {
+		return nil
+	}
+	decoder.sender.nextLoop()
+	for {
+		frame, err := framer.ReadFrame()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if isRTCP(frame.Data) {
+			continue
+		}
+		rtp, err := decoder.decodePkt(frame)
+		if err != nil {
+			return err
+		}
+		// 和第一遍用同一个检查, 每一遍发的包一样
+		if decoder.checkRTP(rtp) != nil {
+			continue
+		}
+		if err := decoder.sender.send(rtp, frame); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package rtptool
+
+import (
+	"log"
+	"sort"
+)
+
+// RFC 3550 A.1
+const (
+	rtpSeqMod   = 1 << 16
+	maxDropout  = 3000
+	maxMisorder = 100
+)
+
+// seqTracker 扩展序列号, 参考RFC 3550 附录A.1的update_seq,
+// 高16位是序列号回绕的次数
+type seqTracker struct {
+	maxSeq uint16
+	// 回绕次数 << 16
+	cycles  uint32
+	baseSeq uint32
+	badSeq  uint32
+	// 序列号跳变后重新开始的次数
+	restarts uint32
+}
+
+func (s *seqTracker) init(seq uint16) {
+	s.baseSeq = uint32(seq)
+	s.maxSeq = seq
+	s.badSeq = rtpSeqMod + 1
+	s.cycles = 0
+}
+
+// extendedMax 目前收到的最大的扩展序列号
+func (s *seqTracker) extendedMax() uint32 {
+	return s.cycles + uint32(s.maxSeq)
+}
+
+// expected 从第一个包到目前最大的序列号, 应该收到的包数
+func (s *seqTracker) expected() uint32 {
+	return s.extendedMax() - s.baseSeq + 1
+}
+
+// wraps 序列号回绕的次数
+func (s *seqTracker) wraps() uint32 {
+	return s.cycles >> 16
+}
+
+// update 返回seq对应的扩展序列号, 序列号跳变太大时返回false,
+// 连续两个包都是跳变之后的序列号时, 认为对端重新开始了, 重新初始化
+func (s *seqTracker) update(seq uint16) (uint32, bool) {
+	udelta := seq - s.maxSeq
+	switch {
+	case udelta < maxDropout:
+		// 顺序的, 允许中间有丢包
+		if seq < s.maxSeq {
+			s.cycles += rtpSeqMod
+		}
+		s.maxSeq = seq
+		return s.extendedMax(), true
+	case uint32(udelta) <= rtpSeqMod-maxMisorder:
+		// 序列号跳变很大
+		if uint32(seq) == s.badSeq {
+			s.init(seq)
+			s.restarts++
+			return s.extendedMax(), true
+		}
+		s.badSeq = (uint32(seq) + 1) & (rtpSeqMod - 1)
+		return 0, false
+	}
+	// 重复或者乱序的包, 在最大序列号之前
+	return s.extendedMax() - uint32(s.maxSeq-seq), true
+}
+
+// reorderBuffer 按扩展序列号重新排序, 最多缓存window个包,
+// window为0时不排序
+type reorderBuffer struct {
+	window  int
+	started bool
+	nextSeq uint32
+	pkts    []*RTP
+}
+
+// push 加入一个包, 返回可以按顺序输出的包
+func (b *reorderBuffer) push(rtp *RTP) []*RTP {
+	if b.window == 0 {
+		return []*RTP{rtp}
+	}
+	if b.started && int32(rtp.extSeq-b.nextSeq) < 0 {
+		log.Println("drop late or duplicate pkt, ssrc:", rtp.SSRC, "seqNum:", rtp.seqNum, "expect:", b.nextSeq&0xffff)
+		return nil
+	}
+	idx := sort.Search(len(b.pkts), func(i int) bool {
+		return int32(b.pkts[i].extSeq-rtp.extSeq) >= 0
+	})
+	if idx < len(b.pkts) && b.pkts[idx].extSeq == rtp.extSeq {
+		// 重复的包
+		return nil
+	}
+	b.pkts = append(b.pkts, nil)
+	copy(b.pkts[idx+1:], b.pkts[idx:])
+	b.pkts[idx] = rtp
+	var out []*RTP
+	for len(b.pkts) > 0 && ((b.started && b.pkts[0].extSeq == b.nextSeq) || len(b.pkts) > b.window) {
+		out = append(out, b.pop())
+	}
+	return out
+}
+
+// flush 输入结束, 按顺序返回缓存里所有的包
+func (b *reorderBuffer) flush() []*RTP {
+	var out []*RTP
+	for len(b.pkts) > 0 {
+		out = append(out, b.pop())
+	}
+	return out
+}
+
+// reset 序列号重新开始, 清空缓存, 从下一个包开始重新排序
+func (b *reorderBuffer) reset() {
+	b.started = false
+	b.nextSeq = 0
+	b.pkts = nil
+}
+
+func (b *reorderBuffer) pop() *RTP {
+	rtp := b.pkts[0]
+	b.pkts = b.pkts[1:]
+	b.started = true
+	b.nextSeq = rtp.extSeq + 1
+	return rtp
+}
@@ -0,0 +1,141 @@
+package rtptool
+
+import "testing"
+
+func TestSeqTrackerUpdate(t *testing.T) {
+	type step struct {
+		seq    uint16
+		extSeq uint32
+		ok     bool
+	}
+	tests := []struct {
+		name     string
+		first    uint16
+		steps    []step
+		restarts uint32
+		wraps    uint32
+		expected uint32
+	}{
+		{
+			name:  "in order",
+			first: 100,
+			steps: []step{
+				{101, 101, true},
+				{102, 102, true},
+			},
+			expected: 3,
+		},
+		{
+			name:  "loss",
+			first: 100,
+			steps: []step{
+				{105, 105, true},
+				{100 + maxDropout - 1, 100 + maxDropout - 1, true},
+			},
+			expected: maxDropout,
+		},
+		{
+			name:  "wrap",
+			first: 65534,
+			steps: []step{
+				{65535, 65535, true},
+				{0, rtpSeqMod, true},
+				{1, rtpSeqMod + 1, true},
+			},
+			wraps:    1,
+			expected: 4,
+		},
+		{
+			name:  "misorder and duplicate",
+			first: 100,
+			steps: []step{
+				{103, 103, true},
+				{101, 101, true},
+				{103, 103, true},
+				{102, 102, true},
+				{104, 104, true},
+			},
+			expected: 5,
+		},
+		{
+			name:  "misorder across wrap",
+			first: 65534,
+			steps: []step{
+				{1, rtpSeqMod + 1, true},
+				{65535, 65535, true},
+				{0, rtpSeqMod, true},
+			},
+			wraps:    1,
+			expected: 4,
+		},
+		{
+			name:  "late pkt within max misorder is not a jump",
+			first: 1000,
+			steps: []step{
+				{1000 - maxMisorder + 1, 1000 - maxMisorder + 1, true},
+			},
+			expected: 1,
+		},
+		{
+			name:  "single jump is dropped",
+			first: 100,
+			steps: []step{
+				{20000, 0, false},
+				{101, 101, true},
+			},
+			expected: 2,
+		},
+		{
+			name:  "two jumps in a row restart",
+			first: 100,
+			steps: []step{
+				{20000, 0, false},
+				{20001, 20001, true},
+				{20002, 20002, true},
+			},
+			restarts: 1,
+			expected: 2,
+		},
+		{
+			name:  "jumps not in a row do not restart",
+			first: 100,
+			steps: []step{
+				{20000, 0, false},
+				{30000, 0, false},
+				{101, 101, true},
+			},
+			expected: 2,
+		},
+		{
+			name:  "restart to a lower seq",
+			first: 40000,
+			steps: []step{
+				{100, 0, false},
+				{101, 101, true},
+			},
+			restarts: 1,
+			expected: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s seqTracker
+			s.init(tt.first)
+			for i, step := range tt.steps {
+				extSeq, ok := s.update(step.seq)
+				if ok != step.ok || (ok && extSeq != step.extSeq) {
+					t.Fatalf("step %d seq %d: got (%d, %v), want (%d, %v)", i, step.seq, extSeq, ok, step.extSeq, step.ok)
+				}
+			}
+			if s.restarts != tt.restarts {
+				t.Errorf("restarts: got %d, want %d", s.restarts, tt.restarts)
+			}
+			if s.wraps() != tt.wraps {
+				t.Errorf("wraps: got %d, want %d", s.wraps(), tt.wraps)
+			}
+			if s.expected() != tt.expected {
+				t.Errorf("expected: got %d, want %d", s.expected(), tt.expected)
+			}
+		})
+	}
+}
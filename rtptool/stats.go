@@ -0,0 +1,132 @@
+package rtptool
+
+import (
+	"log"
+)
+
+// 用来判断重复包的最近收到的序列号个数
+const recentSeqWindow = 4096
+
+// seqGap 一段连续丢失的序列号 [startSeq, endSeq], 都是扩展序列号
+type seqGap struct {
+	startSeq uint32
+	endSeq   uint32
+	// 缺口前后收到的包在输入文件中的偏移
+	prevPos int64
+	nextPos int64
+}
+
+func (gap *seqGap) lost() uint32 {
+	return gap.endSeq - gap.startSeq + 1
+}
+
+// streamStats 一个流的丢包、重复、乱序统计
+type streamStats struct {
+	received   uint32
+	duplicates uint32
+	reorders   uint32
+	// 序列号重新开始之前的期望包数
+	expectedPrior uint32
+	lastPos       int64
+	gaps          []seqGap
+	// 最近收到的扩展序列号+1, 0表示没有
+	recent [recentSeqWindow]uint32
+}
+
+// update 统计一个包, lastSeq是收到这个包之前的最大扩展序列号
+func (stats *streamStats) update(extSeq, lastSeq uint32, isNew bool, pos int64) {
+	idx := extSeq % recentSeqWindow
+	if stats.recent[idx] == extSeq+1 {
+		stats.duplicates++
+		return
+	}
+	stats.recent[idx] = extSeq + 1
+	stats.received++
+	diff := int32(extSeq - lastSeq)
+	switch {
+	case isNew || diff == 1:
+	case diff > 1:
+		stats.gaps = append(stats.gaps, seqGap{
+			startSeq: lastSeq + 1,
+			endSeq:   extSeq - 1,
+			prevPos:  stats.lastPos,
+			nextPos:  pos,
+		})
+	case diff <= 0:
+		stats.reorders++
+		stats.fillGap(extSeq, pos)
+	}
+	if diff > 0 || isNew {
+		stats.lastPos = pos
+	}
+}
+
+// restart 序列号跳变后重新开始, 之前的期望包数累加起来
+func (stats *streamStats) restart(expected uint32) {
+	stats.expectedPrior += expected
+	stats.recent = [recentSeqWindow]uint32{}
+}
+
+// fillGap 乱序到达的包补上了之前记录的缺口, 缺口可能被分成两段
+func (stats *streamStats) fillGap(extSeq uint32, pos int64) {
+	for i := len(stats.gaps) - 1; i >= 0; i-- {
+		gap := &stats.gaps[i]
+		if int32(extSeq-gap.startSeq) < 0 || int32(gap.endSeq-extSeq) < 0 {
+			continue
+		}
+		switch {
+		case gap.startSeq == gap.endSeq:
+			stats.gaps = append(stats.gaps[:i], stats.gaps[i+1:]...)
+		case extSeq == gap.startSeq:
+			gap.startSeq++
+			gap.prevPos = pos
+		case extSeq == gap.endSeq:
+			gap.endSeq--
+			gap.nextPos = pos
+		default:
+			tail := seqGap{
+				startSeq: extSeq + 1,
+				endSeq:   gap.endSeq,
+				prevPos:  pos,
+				nextPos:  gap.nextPos,
+			}
+			gap.endSeq = extSeq - 1
+			gap.nextPos = pos
+			stats.gaps = append(stats.gaps, seqGap{})
+			copy(stats.gaps[i+2:], stats.gaps[i+1:])
+			stats.gaps[i+1] = tail
+		}
+		return
+	}
+}
+
+// lost 丢包数, expected是序列号重新开始之后的期望包数
+func (stats *streamStats) lost(expected uint32) int64 {
+	return int64(expected+stats.expectedPrior) - int64(stats.received)
+}
+
+func (stats *streamStats) dump(expected uint32) {
+	lost := stats.lost(expected)
+	expected += stats.expectedPrior
+	lossRate := 0.0
+	if expected > 0 {
+		lossRate = float64(lost) * 100 / float64(expected)
+	}
+	maxBurst := uint32(0)
+	for _, gap := range stats.gaps {
+		if gap.lost() > maxBurst {
+			maxBurst = gap.lost()
+		}
+	}
+	log.Println("\texpected pkt count:", expected)
+	log.Println("\treceived pkt count:", stats.received)
+	log.Printf("\tlost pkt count: %d (%.3f%%)", lost, lossRate)
+	log.Println("\tgap count:", len(stats.gaps))
+	log.Println("\tmax burst loss:", maxBurst)
+	log.Println("\tduplicate pkt count:", stats.duplicates)
+	log.Println("\treorder count:", stats.reorders)
+	for _, gap := range stats.gaps {
+		log.Printf("\t\tgap seq: %d-%d lost: %d pos: %d(0x%x)-%d(0x%x)",
+			gap.startSeq&0xffff, gap.endSeq&0xffff, gap.lost(), gap.prevPos, gap.prevPos, gap.nextPos, gap.nextPos)
+	}
+}
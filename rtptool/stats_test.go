@@ -0,0 +1,145 @@
+package rtptool
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStreamStats(t *testing.T) {
+	tests := []struct {
+		name       string
+		seqs       []uint16
+		received   uint32
+		lost       int64
+		duplicates uint32
+		reorders   uint32
+		gaps       []seqGap
+	}{
+		{
+			name:     "in order",
+			seqs:     []uint16{1, 2, 3, 4, 5},
+			received: 5,
+		},
+		{
+			// 缺口前后的包偏移是输入中的位置, 这里用包的下标
+			name:     "loss",
+			seqs:     []uint16{1, 2, 5, 6},
+			received: 4,
+			lost:     2,
+			gaps:     []seqGap{{startSeq: 3, endSeq: 4, prevPos: 1, nextPos: 2}},
+		},
+		{
+			name:     "loss across wrap",
+			seqs:     []uint16{65534, 1},
+			received: 2,
+			lost:     2,
+			gaps:     []seqGap{{startSeq: 65535, endSeq: rtpSeqMod, prevPos: 0, nextPos: 1}},
+		},
+		{
+			name:       "duplicate",
+			seqs:       []uint16{1, 2, 2, 3},
+			received:   3,
+			duplicates: 1,
+		},
+		{
+			name:       "duplicate of a late pkt",
+			seqs:       []uint16{1, 4, 3, 3},
+			received:   3,
+			lost:       1,
+			duplicates: 1,
+			reorders:   1,
+			gaps:       []seqGap{{startSeq: 2, endSeq: 2, prevPos: 0, nextPos: 2}},
+		},
+		{
+			name:     "reorder fills a one pkt gap",
+			seqs:     []uint16{1, 3, 2},
+			received: 3,
+			reorders: 1,
+		},
+		{
+			name:     "reorder at gap start",
+			seqs:     []uint16{1, 5, 2},
+			received: 3,
+			lost:     2,
+			reorders: 1,
+			gaps:     []seqGap{{startSeq: 3, endSeq: 4, prevPos: 2, nextPos: 1}},
+		},
+		{
+			name:     "reorder at gap end",
+			seqs:     []uint16{1, 5, 4},
+			received: 3,
+			lost:     2,
+			reorders: 1,
+			gaps:     []seqGap{{startSeq: 2, endSeq: 3, prevPos: 0, nextPos: 2}},
+		},
+		{
+			name:     "reorder splits a gap",
+			seqs:     []uint16{1, 6, 3},
+			received: 3,
+			lost:     3,
+			reorders: 1,
+			gaps: []seqGap{
+				{startSeq: 2, endSeq: 2, prevPos: 0, nextPos: 2},
+				{startSeq: 4, endSeq: 5, prevPos: 2, nextPos: 1},
+			},
+		},
+		{
+			name:     "split keeps later gaps in order",
+			seqs:     []uint16{1, 6, 9, 3},
+			received: 4,
+			lost:     5,
+			reorders: 1,
+			gaps: []seqGap{
+				{startSeq: 2, endSeq: 2, prevPos: 0, nextPos: 3},
+				{startSeq: 4, endSeq: 5, prevPos: 3, nextPos: 1},
+				{startSeq: 7, endSeq: 8, prevPos: 1, nextPos: 2},
+			},
+		},
+		{
+			// 跳变的第一个包被丢掉, 第二个包开始重新统计
+			name:     "restart",
+			seqs:     []uint16{100, 101, 20000, 20001, 20002},
+			received: 4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seq seqTracker
+			var stats streamStats
+			for i, s := range tt.seqs {
+				isNew := i == 0
+				if isNew {
+					seq.init(s)
+				}
+				// 和isRTPValid里的顺序一样
+				lastSeq := seq.extendedMax()
+				expected := seq.expected()
+				restarts := seq.restarts
+				extSeq, ok := seq.update(s)
+				if !ok {
+					continue
+				}
+				if seq.restarts != restarts {
+					stats.restart(expected)
+					isNew = true
+				}
+				stats.update(extSeq, lastSeq, isNew, int64(i))
+			}
+			if stats.received != tt.received {
+				t.Errorf("received: got %d, want %d", stats.received, tt.received)
+			}
+			if lost := stats.lost(seq.expected()); lost != tt.lost {
+				t.Errorf("lost: got %d, want %d", lost, tt.lost)
+			}
+			if stats.duplicates != tt.duplicates {
+				t.Errorf("duplicates: got %d, want %d", stats.duplicates, tt.duplicates)
+			}
+			if stats.reorders != tt.reorders {
+				t.Errorf("reorders: got %d, want %d", stats.reorders, tt.reorders)
+			}
+			if len(stats.gaps) != len(tt.gaps) || (len(tt.gaps) > 0 && !reflect.DeepEqual(stats.gaps, tt.gaps)) {
+				t.Errorf("gaps: got %+v, want %+v", stats.gaps, tt.gaps)
+			}
+		})
+	}
+}
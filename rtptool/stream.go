@@ -0,0 +1,141 @@
+package rtptool
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RTPStream 一个ssrc对应的流的状态, 每个流有自己的序列号、时间戳、计数和输出
+type RTPStream struct {
+	SSRC    uint32
+	PT      uint32
+	seq     seqTracker
+	reorder reorderBuffer
+	// 序列号重新开始了, 输出前要清空乱序缓存和拼帧的序列号
+	restarted      bool
+	stats          streamStats
+	timing         streamTiming
+	firstTimestamp uint32
+	lastTimestamp  uint32
+	pktCount       uint32
+	byteCount      uint64
+	assembler      psAssembler
+	// 输出的mpg文件名, 没有配置-output-file时为空
+	outputFile string
+	// 负载直接写到文件, 不在内存里缓存, 第一个流用decoder的OutputFile
+	output     *os.File
+	outputSize int64
+	// 第一个流拼好的ps同时写给ps解析
+	psWriter io.Writer
+	// 上次打印实时统计时的计数
+	rollingPkts  uint32
+	rollingLost  int64
+	rollingBytes uint64
+}
+
+func newRTPStream(rtp *RTP, param *ConsoleParam) *RTPStream {
+	stream := &RTPStream{
+		SSRC:           rtp.SSRC,
+		PT:             rtp.PT,
+		reorder:        reorderBuffer{window: param.ReorderWindow},
+		timing:         newStreamTiming(clockRateOf(rtp.PT, param.ClockRate)),
+		firstTimestamp: rtp.timestamp,
+		lastTimestamp:  rtp.timestamp,
+	}
+	stream.assembler.mode = param.PsStart
+	if stream.assembler.mode == "" {
+		stream.assembler.mode = PsStartKeyFrame
+	}
+	stream.seq.init(uint16(rtp.seqNum))
+	return stream
+}
+
+// streamOutputFile 第一个流用-output-file指定的文件名, 其他的流在文件名后面加上ssrc
+// 例如 output.mpg -> output_12345678.mpg
+func streamOutputFile(name string, ssrc uint32, first bool) string {
+	if name == "" || first {
+		return name
+	}
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(name, ext), ssrc, ext)
+}
+
+// getStream 返回rtp所属的流, 第一次见到这个ssrc时创建
+func (decoder *RTPDecoder) getStream(rtp *RTP) (*RTPStream, bool) {
+	if stream, ok := decoder.streams[rtp.SSRC]; ok {
+		return stream, false
+	}
+	stream := newRTPStream(rtp, decoder.param)
+	stream.outputFile = streamOutputFile(decoder.param.OutputFile, rtp.SSRC, len(decoder.streamList) == 0)
+	if len(decoder.streamList) == 0 {
+		stream.output = decoder.OutputFile
+		stream.psWriter = decoder.psWriter
+	}
+	decoder.streams[rtp.SSRC] = stream
+	decoder.streamList = append(decoder.streamList, stream)
+	log.Println("new stream, ssrc:", rtp.SSRC, "pt:", rtp.PT, "first pkt seqNum:", rtp.seqNum, "pos:", decoder.getPos())
+	return stream, true
+}
+
+// write 把拼好的负载追加到输出文件, 第一次写的时候打开文件
+func (stream *RTPStream) write(data []byte) error {
+	if stream.psWriter != nil {
+		if _, err := stream.psWriter.Write(data); err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+	if stream.outputFile == "" {
+		return nil
+	}
+	if stream.output == nil {
+		output, err := os.OpenFile(stream.outputFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		stream.output = output
+	}
+	if _, err := stream.output.Write(data); err != nil {
+		log.Println(err)
+		return err
+	}
+	stream.outputSize += int64(len(data))
+	return nil
+}
+
+// save 输入结束, 刷新并关闭自己打开的输出文件
+func (stream *RTPStream) save(shared *os.File) error {
+	if stream.output == nil {
+		return nil
+	}
+	if err := stream.output.Sync(); err != nil {
+		log.Println(err)
+		return err
+	}
+	if stream.output == shared {
+		return nil
+	}
+	return stream.output.Close()
+}
+
+func (stream *RTPStream) dump() {
+	log.Println("ssrc:", stream.SSRC)
+	log.Println("\tpt:", stream.PT)
+	log.Println("\tfirst seq num:", stream.seq.baseSeq)
+	log.Println("\tlast seq num:", stream.seq.maxSeq)
+	log.Println("\tseq num wraps:", stream.seq.wraps())
+	log.Println("\tfirst timestamp:", stream.firstTimestamp)
+	log.Println("\tlast timestamp:", stream.lastTimestamp)
+	log.Println("\tpkt count:", stream.pktCount)
+	stream.stats.dump(stream.seq.expected())
+	stream.timing.dump()
+	stream.assembler.dump()
+	if stream.outputFile != "" {
+		log.Println("\toutput file:", stream.outputFile, "size:", stream.outputSize)
+	}
+}
@@ -0,0 +1,166 @@
+package rtptool
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"strings"
+)
+
+const (
+	// tcp主动发送, 连接到流媒体服务器(服务器为GB28181的tcp被动模式)
+	SendTCP = "tcp"
+	// tcp被动发送, 在-local-addr上等流媒体服务器连上来(服务器为GB28181的tcp主动模式)
+	SendTCPPassive = "tcp-passive"
+	// udp发送, 一个报文一个rtp包
+	SendUDP = "udp"
+)
+
+var ErrCheckSendAddr = errors.New("check send addr error")
+
+// sendTarget 发送rtp的一个目的地
+type sendTarget interface {
+	write(pkt []byte) error
+	close() error
+	String() string
+}
+
+// tcpTarget 按rfc4571发送, 每个包前面加上2个字节的长度
+type tcpTarget struct {
+	conn net.Conn
+}
+
+func (t *tcpTarget) write(pkt []byte) error {
+	// 2个字节为rtp长度本身
+	data := make([]byte, 2+len(pkt))
+	binary.BigEndian.PutUint16(data, uint16(len(pkt)))
+	copy(data[2:], pkt)
+	_, err := t.conn.Write(data)
+	return err
+}
+
+func (t *tcpTarget) close() error {
+	return t.conn.Close()
+}
+
+func (t *tcpTarget) String() string {
+	return "tcp " + t.conn.RemoteAddr().String()
+}
+
+// udpTarget 多个udp目的地共用一个socket, 绑定了本地端口时所有目的地看到的源端口相同
+type udpTarget struct {
+	conn net.PacketConn
+	addr net.Addr
+}
+
+func (t *udpTarget) write(pkt []byte) error {
+	_, err := t.conn.WriteTo(pkt, t.addr)
+	return err
+}
+
+// close socket是共用的, 由rtpSender关闭一次
+func (t *udpTarget) close() error {
+	return nil
+}
+
+func (t *udpTarget) String() string {
+	return "udp " + t.addr.String()
+}
+
+// openTargets 按-send-transport打开所有的目的地, -remote-addr可以用逗号分隔多个地址, 同一份rtp发给每一个.
+// udp时还返回所有目的地共用的socket, 由调用者关闭
+func openTargets(param *ConsoleParam) ([]sendTarget, net.PacketConn, error) {
+	var addrs []string
+	for _, addr := range strings.Split(param.RemoteAddr, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	switch param.SendTransport {
+	case SendTCP:
+		targets, err := dialTCPTargets(addrs, param.LocalAddr)
+		return targets, nil, err
+	case SendTCPPassive:
+		targets, err := acceptTCPTarget(param.LocalAddr)
+		return targets, nil, err
+	case SendUDP:
+		return udpTargets(addrs, param.LocalAddr)
+	}
+	log.Println("unknown send transport:", param.SendTransport)
+	return nil, nil, ErrCheckSendAddr
+}
+
+// dialTCPTargets 连接每一个目的地, 有一个连不上时关掉已经连上的.
+// 每个连接要单独的本地端口, 多个目的地时-local-addr不能指定端口
+func dialTCPTargets(addrs []string, localAddr string) ([]sendTarget, error) {
+	dialer := &net.Dialer{}
+	if localAddr != "" {
+		local, err := net.ResolveTCPAddr("tcp", localAddr)
+		if err != nil {
+			log.Println(err)
+			return nil, ErrCheckSendAddr
+		}
+		if local.Port != 0 && len(addrs) > 1 {
+			log.Println("tcp to several remote addrs can not bind the same local port:", localAddr)
+			return nil, ErrCheckSendAddr
+		}
+		dialer.LocalAddr = local
+	}
+	var targets []sendTarget
+	for _, addr := range addrs {
+		conn, err := dialer.Dial("tcp", addr)
+		if err != nil {
+			log.Println(err)
+			for _, target := range targets {
+				target.close()
+			}
+			return nil, err
+		}
+		log.Println("connected to:", conn.RemoteAddr(), "local:", conn.LocalAddr())
+		targets = append(targets, &tcpTarget{conn: conn})
+	}
+	return targets, nil
+}
+
+// acceptTCPTarget 在localAddr上等流媒体服务器连上来, GB28181一个连接对应一路流, 只接受一个连接
+func acceptTCPTarget(localAddr string) ([]sendTarget, error) {
+	if localAddr == "" {
+		log.Println("tcp passive must set local addr")
+		return nil, ErrCheckSendAddr
+	}
+	listener, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	defer listener.Close()
+	log.Println("wait for connection on:", listener.Addr())
+	conn, err := listener.Accept()
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	log.Println("accept connection from:", conn.RemoteAddr())
+	return []sendTarget{&tcpTarget{conn: conn}}, nil
+}
+
+func udpTargets(addrs []string, localAddr string) ([]sendTarget, net.PacketConn, error) {
+	conn, err := net.ListenPacket("udp", localAddr)
+	if err != nil {
+		log.Println(err)
+		return nil, nil, err
+	}
+	var targets []sendTarget
+	for _, addr := range addrs {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			log.Println(err)
+			conn.Close()
+			return nil, nil, ErrCheckSendAddr
+		}
+		log.Println("send udp to:", udpAddr, "local:", conn.LocalAddr())
+		targets = append(targets, &udpTarget{conn: conn, addr: udpAddr})
+	}
+	return targets, conn, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"dumpPayloadFromRTP/rtptool"
+	"flag"
+	"log"
+	"strings"
+	"time"
+)
+
+// addSendFlags 发送的目的地和节奏
+func addSendFlags(fs *flag.FlagSet, param *rtptool.ConsoleParam) {
+	fs.StringVar(&param.RemoteAddr, "remote-addr", "", "send rtp to remote ip:port, comma separated for several destinations")
+	fs.StringVar(&param.SendTransport, "send-transport", rtptool.SendTCP, "send transport: tcp(connect to remote), tcp-passive(wait on -local-addr for remote to connect) or udp")
+	fs.StringVar(&param.LocalAddr, "local-addr", "", "local ip:port to bind when sending")
+	fs.IntVar(&param.SendRtpCount, "send-rtp-count", 0, "每一遍发送多少个rtp就不发了, 0不限制")
+	fs.StringVar(&param.Pace, "pace", rtptool.PaceFixed, "send pace: none, fixed(-pace-interval), rtp(by rtp timestamp) or arrival(by capture time)")
+	fs.DurationVar(&param.PaceInterval, "pace-interval", 5*time.Millisecond, "interval between rtp when -pace fixed")
+	fs.Float64Var(&param.Speed, "speed", 1, "send speed multiplier when -pace rtp/arrival")
+	fs.IntVar(&param.Loop, "loop", 1, "send input this many times, 0 forever")
+	fs.IntVar(&param.StartSeq, "start-seq", -1, "start sending at this rtp seq num, -1 from the first")
+	fs.Int64Var(&param.StartOffset, "start-offset", 0, "start sending at the first rtp after this input offset")
+	fs.BoolVar(&param.Rewrite, "rewrite", false, "rewrite seq num and timestamp so loops look like one continuous stream")
+	fs.StringVar(&param.RewriteSSRC, "rewrite-ssrc", "", "rewrite ssrc of sent rtp, e.g. 1234 or 0x5678")
+}
+
+// addImpairFlags 发送时模拟的网络损伤
+func addImpairFlags(fs *flag.FlagSet, param *rtptool.ConsoleParam) {
+	fs.Float64Var(&param.LossRate, "loss", 0, "randomly drop this percent of sent rtp")
+	fs.StringVar(&param.GELoss, "ge-loss", "", "bursty loss by Gilbert-Elliott model, percent p,r[,loss-good,loss-bad], e.g. 1,30")
+	fs.Float64Var(&param.DupRate, "dup", 0, "duplicate this percent of sent rtp")
+	fs.Float64Var(&param.ReorderRate, "reorder", 0, "send this percent of rtp late by -reorder-depth pkts")
+	fs.IntVar(&param.ReorderDepth, "reorder-depth", 3, "how many pkts a reordered rtp is sent after")
+	fs.Float64Var(&param.CorruptRate, "corrupt", 0, "flip one payload bit in this percent of sent rtp")
+	fs.DurationVar(&param.Delay, "delay", 0, "delay every sent rtp")
+	fs.DurationVar(&param.Jitter, "jitter", 0, "add random delay in [-jitter, jitter] to every sent rtp, may reorder")
+	fs.Int64Var(&param.ImpairSeed, "impair-seed", 0, "random seed of impairment, 0 use current time")
+}
+
+func runSend(args []string) {
+	param := &rtptool.ConsoleParam{}
+	fs := newFlagSet("send", param)
+	addInputFlags(fs, param)
+	addFilterFlags(fs, param)
+	addSendFlags(fs, param)
+	addImpairFlags(fs, param)
+	if err := parseArgs(fs, args, &param.InputFile); err != nil {
+		return
+	}
+	if param.RemoteAddr == "" && param.SendTransport != rtptool.SendTCPPassive {
+		log.Println("must input remote addr")
+		fs.Usage()
+		return
+	}
+	decodeRtp(param)
+}
+
+// replay 循环发送, 每一遍重新打开输入, 输入是标准输入或者socket时只能发一遍.
+// 一遍发到-send-rtp-count个包时接着发下一遍, 最后返回ErrSendDone
+func replay(decoder *rtptool.RTPDecoder, param *rtptool.ConsoleParam) error {
+	if param.InputFile == "-" || strings.HasPrefix(param.InputFile, "tcp://") {
+		log.Println("can not loop input:", param.InputFile)
+		return nil
+	}
+	var done error
+	for i := 1; param.Loop <= 0 || i < param.Loop; i++ {
+		log.Println("loop:", i+1)
+		input, _, err := openInput(param.InputFile)
+		if err != nil {
+			return err
+		}
+		framer, err := rtptool.NewFramer(input, param.Framing, param.PcapStream)
+		if err != nil {
+			input.Close()
+			return err
+		}
+		err = decoder.Replay(framer)
+		input.Close()
+		if err == rtptool.ErrSendDone {
+			done = err
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return done
+}
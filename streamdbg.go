@@ -1,14 +1,16 @@
 package main
 
 import (
-	"bytes"
-	"dumpPayloadFromRTP/bitreader"
 	"dumpPayloadFromRTP/psparser"
 	"dumpPayloadFromRTP/rtptool"
 	"errors"
 	"flag"
-	"io/ioutil"
+	"fmt"
+	"io"
 	"log"
+	"net"
+	"os"
+	"strings"
 	"time"
 )
 
@@ -17,44 +19,236 @@ var (
 	ErrCheckOutputFile = errors.New("check output file error")
 )
 
-func parseConsoleParam() (*rtptool.ConsoleParam, error) {
-	param := &rtptool.ConsoleParam{}
-	flag.StringVar(&param.InputFile, "file", "", "input file")
-	flag.StringVar(&param.OutputFile, "output-file", "", "output mpg file")
-	flag.StringVar(&param.CsvFile, "csv-file", "", "output csv file")
-	flag.StringVar(&param.SearchBytes, "search-bytes", "", "search bytes get rtp info")
-	flag.StringVar(&param.RemoteAddr, "remote-addr", "", "remote ip:port")
-	flag.BoolVar(&param.ShowProgress, "show-progress", false, "show progress bar")
-	flag.BoolVar(&param.Verbose, "Verbose", false, "log Verbose")
-	flag.IntVar(&param.SendRtpCount, "send-rtp-count", 100, "发送多少个rtp就不发了")
-	flag.BoolVar(&param.DumpOneFrame, "dump-one-frame", false, "从h264文件摘出第一帧")
-	flag.StringVar(&param.PsFile, "psfile", "", "input ps file")
-	flag.StringVar(&param.OutputAudioFile, "output-audio", "./output.audio", "output audio file")
-	flag.StringVar(&param.OutputVideoFile, "output-video", "./output.video", "output video file")
-	flag.BoolVar(&param.DumpAudio, "dump-audio", false, "dump audio")
-	flag.BoolVar(&param.DumpVideo, "dump-video", false, "dump video")
-	flag.BoolVar(&param.PrintPsHeader, "print-ps-header", false, "print ps header")
-	flag.BoolVar(&param.PrintSysHeader, "print-sys-header", false, "print system header")
-	flag.BoolVar(&param.PrintPsm, "print-psm", false, "print porgram stream map")
-	flag.BoolVar(&param.DumpPesStartBytes, "dump-pes-start-bytes", false, "dump pes start bytes")
-	flag.IntVar(&param.DumpVideoFrameCnt, "dump-video-frame-cnt", 1, "dump video frame count")
-	flag.Parse()
-	if param.InputFile == "" {
+// command 一个子命令, 每个子命令有自己的参数
+type command struct {
+	name string
+	desc string
+	run  func(args []string)
+}
+
+// 在init里赋值, 子命令的Usage要用到这个列表
+var commands []command
+
+func init() {
+	commands = []command{
+		{"rtp", "decode rtp, check and print per-stream statistics, save ps and csv", runRtp},
+		{"ps", "decode mpeg ps, print headers and dump audio/video es", runPs},
+		{"send", "replay rtp to a media server with pacing and network impairment", runSend},
+		{"listen", "receive rtp live over tcp or udp like a GB28181 media server", runListen},
+		{"search", "search bytes in rtp, print seq num and timestamp of the pkts", runSearch},
+		{"stats", "print per-stream statistics only, no output files", runStats},
+		{"extract", "extract ps payload from rtp, or the first frame from h264", runExtract},
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: streamdbg <command> [flags]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", cmd.name, cmd.desc)
+	}
+	fmt.Fprintln(os.Stderr, "run 'streamdbg <command> -h' for the flags of a command")
+}
+
+// newFlagSet 子命令的参数, -h打印这个子命令的说明和参数. 所有子命令共用的参数也在这里加上
+func newFlagSet(name string, param *rtptool.ConsoleParam) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.BoolVar(&param.Verbose, "Verbose", false, "log Verbose")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: streamdbg %s [flags]\n", name)
+		for _, cmd := range commands {
+			if cmd.name == name {
+				fmt.Fprintln(os.Stderr, cmd.desc)
+			}
+		}
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs 解析子命令的参数, 检查必须的输入文件
+func parseArgs(fs *flag.FlagSet, args []string, file *string) error {
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		log.Println("unknown args:", fs.Args())
+		fs.Usage()
+		return ErrCheckInputFile
+	}
+	if *file == "" {
 		log.Println("must input file")
-		return nil, ErrCheckInputFile
+		fs.Usage()
+		return ErrCheckInputFile
 	}
-	return param, nil
+	return nil
+}
+
+// addInputFlags rtp输入文件的参数
+func addInputFlags(fs *flag.FlagSet, param *rtptool.ConsoleParam) {
+	fs.StringVar(&param.InputFile, "file", "", "input file, tcp payload, rtpdump or pcap/pcapng, - for stdin, tcp://ip:port to read from socket")
+	fs.IntVar(&param.PcapStream, "pcap-stream", 0, "use the nth rtp stream in pcap")
+	fs.StringVar(&param.Framing, "framing", rtptool.FramingAuto, "input framing: auto, tcp(rfc4571 length prefix) or udp(pcap/rtpdump datagram)")
+	fs.BoolVar(&param.ShowProgress, "show-progress", false, "show progress bar")
+}
+
+// addFilterFlags 选择处理哪些rtp
+func addFilterFlags(fs *flag.FlagSet, param *rtptool.ConsoleParam) {
+	fs.StringVar(&param.SSRCFilter, "ssrc", "", "only decode these ssrc, e.g. 1234,0x5678")
+	fs.StringVar(&param.CSRCFilter, "csrc", "", "only decode rtp contains one of these csrc, e.g. 1234,0x5678")
+	fs.IntVar(&param.ClockRate, "clock-rate", 90000, "rtp clock rate of dynamic payload type, 0 use 90000")
+}
+
+// addRtpFlags rtp解析的参数, 解析文件和实时接收共用
+func addRtpFlags(fs *flag.FlagSet, param *rtptool.ConsoleParam) {
+	addFilterFlags(fs, param)
+	fs.StringVar(&param.ExtMap, "ext-map", "", "rtp header extension ids, e.g. 1=abs-send-time,3=transport-cc,4=video-orientation")
+}
+
+// addOutputFlags 解析rtp时输出的文件
+func addOutputFlags(fs *flag.FlagSet, param *rtptool.ConsoleParam) {
+	fs.IntVar(&param.ReorderWindow, "reorder-window", 0, "reorder rtp by seq num before assembling ps, max buffered pkt count, 0 disable")
+	fs.StringVar(&param.OutputFile, "output-file", "", "output mpg file")
+	fs.StringVar(&param.CsvFile, "csv-file", "", "output csv file")
+	fs.StringVar(&param.PsStart, "ps-start", rtptool.PsStartKeyFrame, "where ps output starts: keyframe(first complete key frame) or all(keep everything)")
+}
+
+// addPsFlags ps解析的参数
+func addPsFlags(fs *flag.FlagSet, param *rtptool.ConsoleParam) {
+	fs.StringVar(&param.OutputAudioFile, "output-audio", "./output.audio", "output audio file")
+	fs.StringVar(&param.OutputVideoFile, "output-video", "./output.video", "output video file")
+	fs.BoolVar(&param.DumpAudio, "dump-audio", false, "dump audio")
+	fs.BoolVar(&param.DumpVideo, "dump-video", false, "dump video")
+	fs.BoolVar(&param.PrintPsHeader, "print-ps-header", false, "print ps header")
+	fs.BoolVar(&param.PrintSysHeader, "print-sys-header", false, "print system header")
+	fs.BoolVar(&param.PrintPsm, "print-psm", false, "print porgram stream map")
+	fs.BoolVar(&param.DumpPesStartBytes, "dump-pes-start-bytes", false, "dump pes start bytes")
+	fs.BoolVar(&param.PrintPesHeader, "print-pes-header", false, "print pes header, including pts/dts")
+	fs.DurationVar(&param.PtsGap, "pts-gap", 200*time.Millisecond, "report a gap when pts/dts of a stream jumps more than this, 0 disable")
+	fs.StringVar(&param.AvSyncFile, "av-sync-file", "", "output a/v sync time series, json if the file ends with .json, otherwise csv")
+	fs.DurationVar(&param.AvJump, "av-jump", 100*time.Millisecond, "report a jump when a/v offset changes more than this, 0 disable")
+	fs.BoolVar(&param.PsResync, "resync", false, "on damaged ps, skip to the next pack header and continue instead of stopping")
+	fs.IntVar(&param.DumpVideoFrameCnt, "dump-video-frame-cnt", 1, "dump video frame count")
+}
+
+func runRtp(args []string) {
+	param := &rtptool.ConsoleParam{}
+	fs := newFlagSet("rtp", param)
+	addInputFlags(fs, param)
+	addRtpFlags(fs, param)
+	addOutputFlags(fs, param)
+	fs.BoolVar(&param.ParsePs, "ps", false, "parse ps of the first stream in memory, no need to save mpg and rerun ps")
+	addPsFlags(fs, param)
+	if err := parseArgs(fs, args, &param.InputFile); err != nil {
+		return
+	}
+	decodeRtp(param)
+}
+
+func runPs(args []string) {
+	param := &rtptool.ConsoleParam{}
+	fs := newFlagSet("ps", param)
+	fs.StringVar(&param.PsFile, "file", "", "input ps file, - for stdin, tcp://ip:port to read from socket")
+	addPsFlags(fs, param)
+	if err := parseArgs(fs, args, &param.PsFile); err != nil {
+		return
+	}
+	decodePs(param)
+}
+
+func runSearch(args []string) {
+	param := &rtptool.ConsoleParam{}
+	fs := newFlagSet("search", param)
+	addInputFlags(fs, param)
+	addFilterFlags(fs, param)
+	fs.StringVar(&param.SearchBytes, "bytes", "", "hex bytes to search, e.g. 000001e0")
+	if err := parseArgs(fs, args, &param.InputFile); err != nil {
+		return
+	}
+	if param.SearchBytes == "" {
+		log.Println("must input bytes")
+		fs.Usage()
+		return
+	}
+	decodeRtp(param)
+}
+
+func runStats(args []string) {
+	param := &rtptool.ConsoleParam{}
+	fs := newFlagSet("stats", param)
+	addInputFlags(fs, param)
+	addRtpFlags(fs, param)
+	if err := parseArgs(fs, args, &param.InputFile); err != nil {
+		return
+	}
+	decodeRtp(param)
+}
+
+func runExtract(args []string) {
+	param := &rtptool.ConsoleParam{}
+	fs := newFlagSet("extract", param)
+	addInputFlags(fs, param)
+	addFilterFlags(fs, param)
+	addOutputFlags(fs, param)
+	fs.BoolVar(&param.DumpOneFrame, "h264-first-frame", false, "input is h264 es, extract the first frame")
+	if err := parseArgs(fs, args, &param.InputFile); err != nil {
+		return
+	}
+	if param.OutputFile == "" {
+		log.Println("must input output file")
+		fs.Usage()
+		return
+	}
+	if param.DumpOneFrame {
+		decodeRtp(param)
+		return
+	}
+	input, _, err := openInput(param.InputFile)
+	if err != nil {
+		return
+	}
+	defer input.Close()
+	if err := rtptool.RtpsToMPG(input, param.OutputFile, param); err != nil {
+		log.Println(err)
+	}
+}
+
+// openInput 打开输入, "-"是标准输入, tcp://ip:port 连接过去读, 其他的按文件打开(包括命名管道).
+// 返回的大小只用来显示进度, 不是普通文件时为0
+func openInput(name string) (io.ReadCloser, int64, error) {
+	if name == "-" {
+		return os.Stdin, 0, nil
+	}
+	if strings.HasPrefix(name, "tcp://") {
+		conn, err := net.Dial("tcp", strings.TrimPrefix(name, "tcp://"))
+		if err != nil {
+			log.Println(err)
+			return nil, 0, err
+		}
+		return conn, 0, nil
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		log.Printf("open file: %s error", name)
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return file, 0, nil
+	}
+	return file, info.Size(), nil
 }
 
 func decodePs(param *rtptool.ConsoleParam) {
-	psBuf, err := ioutil.ReadFile(param.PsFile)
+	input, size, err := openInput(param.PsFile)
 	if err != nil {
-		log.Printf("open file: %s error", param.PsFile)
 		return
 	}
-	log.Println(param.PsFile, "file size:", len(psBuf))
-	br := bitreader.NewReader(bytes.NewReader(psBuf))
-	decoder := psparser.NewPsDecoder(br, &psBuf, len(psBuf), param)
+	defer input.Close()
+	log.Println(param.PsFile, "file size:", size)
+	decoder := psparser.NewPsDecoder(input, size, param)
+	if decoder == nil {
+		return
+	}
+	defer decoder.Close()
 	if err := decoder.DecodePsPkts(); err != nil {
 		log.Println(err)
 		return
@@ -62,43 +256,79 @@ func decodePs(param *rtptool.ConsoleParam) {
 	decoder.ShowInfo()
 }
 
+// decodeRtp 解析rtp, 配置了-remote-addr时同时发送
 func decodeRtp(param *rtptool.ConsoleParam) {
-	fileBuf, err := ioutil.ReadFile(param.InputFile)
+	input, size, err := openInput(param.InputFile)
 	if err != nil {
-		log.Printf("open file: %s error", param.InputFile)
 		return
 	}
-	log.Println(param.InputFile, "file size:", len(fileBuf))
-	br := bitreader.NewReader(bytes.NewReader(fileBuf))
-	decoder := rtptool.NewRTPDecoder(br, &fileBuf, len(fileBuf), param)
+	defer input.Close()
+	log.Println(param.InputFile, "file size:", size)
+	// 摘h264的第一帧时输入不是rtp, 不需要切分
+	var framer rtptool.Framer
+	if !param.DumpOneFrame {
+		framer, err = rtptool.NewFramer(input, param.Framing, param.PcapStream)
+		if err != nil {
+			return
+		}
+	}
+	decoder := rtptool.NewRTPDecoder(framer, size, param)
 	if decoder == nil {
 		return
 	}
+	defer decoder.CloseSender()
 	if err := decoder.OpenFiles(); err != nil {
 		return
 	}
+	if param.ParsePs {
+		pipe := startPsPipe(decoder, param)
+		defer pipe.finish()
+	}
 	if param.DumpOneFrame {
-		decoder.DumpOneFrame()
+		if err := decoder.DumpOneFrame(input); err != nil {
+			return
+		}
 		decoder.Save()
 		return
 	}
-	if err := decoder.DecodePkts(); err != nil {
+	// 发到-send-rtp-count个包时这一遍结束, 还要接着循环
+	err = decoder.DecodePkts()
+	if err != nil && err != rtptool.ErrSendDone {
 		log.Println(err)
-		if err == rtptool.ErrSendDone {
-			time.Sleep(10 * time.Second)
-		}
 		return
 	}
 	decoder.Save()
 	decoder.DumpStream()
+	if decoder.Sending() && param.Loop != 1 {
+		if loopErr := replay(decoder, param); loopErr != nil {
+			if loopErr != rtptool.ErrSendDone {
+				log.Println(loopErr)
+				return
+			}
+			err = loopErr
+		}
+	}
+	if err == rtptool.ErrSendDone {
+		log.Println(err)
+		time.Sleep(10 * time.Second)
+	}
 }
 
 func main() {
 	log.SetFlags(log.Lshortfile)
-	param, err := parseConsoleParam()
-	if err != nil {
-		flag.PrintDefaults()
-		return
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
 	}
-	decodePs(param)
+	for _, cmd := range commands {
+		if cmd.name == os.Args[1] {
+			cmd.run(os.Args[2:])
+			return
+		}
+	}
+	if os.Args[1] != "-h" && os.Args[1] != "help" {
+		log.Println("unknown command:", os.Args[1])
+	}
+	usage()
+	os.Exit(2)
 }